@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestResolveDuplicateActiveChats(t *testing.T) {
+	defer func(resolve bool) { resolveDuplicateChats = resolve }(resolveDuplicateChats)
+
+	for _, resolve := range []bool{false, true} {
+		useTestRegistry(t)
+		resolveDuplicateChats = resolve
+		store := newFakeStore()
+		for _, chatID := range []string{"new", "old", "older"} {
+			store.addChat(Chat{ChatID: chatID, UserEmail: "user@example.com"})
+		}
+		duplicates := []duplicateActiveChats{{UserEmail: "user@example.com", ChatIDs: []string{"new", "old", "older"}}}
+
+		if ok := resolveDuplicateActiveChats(context.Background(), store, duplicates); ok != resolve {
+			t.Errorf("resolve=%v: returned %v", resolve, ok)
+		}
+		for _, chatID := range []string{"new", "old", "older"} {
+			chat, _ := store.chat(chatID)
+			wantStatus, wantNotices := "active", 0
+			if resolve && chatID != "new" {
+				wantStatus, wantNotices = "ended", 1
+			}
+			if chat.Status != wantStatus || len(chat.Messages) != wantNotices {
+				t.Errorf("resolve=%v: chat %s is %q with %d messages, want %q with %d", resolve, chatID, chat.Status, len(chat.Messages), wantStatus, wantNotices)
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Shared credentials for the admin REST routes: a token sent in the
+// X-Admin-Token header (ADMIN_TOKEN), or basic auth (ADMIN_BASIC_USER and
+// ADMIN_BASIC_PASSWORD). With neither set the routes stay open. They guard
+// only routes that take no bearer token; routes that authenticate the caller
+// check the token's admin role instead, never both.
+var (
+	adminToken         = getEnv("ADMIN_TOKEN", "")
+	adminBasicUser     = getEnv("ADMIN_BASIC_USER", "")
+	adminBasicPassword = getEnv("ADMIN_BASIC_PASSWORD", "")
+)
+
+const adminTokenHeader = "X-Admin-Token"
+
+func adminAuthEnabled() bool {
+	return adminToken != "" || adminBasicUser != ""
+}
+
+// Whether the request carries valid admin credentials; always true when none are configured
+func hasAdminCredentials(r *http.Request) bool {
+	if !adminAuthEnabled() {
+		return true
+	}
+	if adminToken != "" {
+		if token := r.Header.Get(adminTokenHeader); token != "" && secureEqual(token, adminToken) {
+			return true
+		}
+	}
+	if adminBasicUser != "" {
+		user, password, ok := r.BasicAuth()
+		// Compare both so a wrong user takes as long as a wrong password
+		userOK := secureEqual(user, adminBasicUser)
+		passwordOK := secureEqual(password, adminBasicPassword)
+		if ok && userOK && passwordOK {
+			return true
+		}
+	}
+	return false
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Reject requests to admin routes without the shared admin credentials
+func requireAdminCredentials(c *gin.Context) {
+	if hasAdminCredentials(c.Request) {
+		c.Next()
+		return
+	}
+	rejectAdminCredentials(c)
+}
+
+func rejectAdminCredentials(c *gin.Context) {
+	if adminBasicUser != "" {
+		c.Header("WWW-Authenticate", `Basic realm="admin"`)
+	}
+	abortWithError(c, http.StatusUnauthorized, codeUnauthorized, "Admin credentials required")
+}
+
+// Warn at startup when the admin routes are left open
+func logAdminAuth() {
+	if !adminAuthEnabled() {
+		slog.Warn("ADMIN_TOKEN and ADMIN_BASIC_USER are not set; admin routes are open", "event", "startup")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// An agent who leaves and comes back within AGENT_PRESENCE_DEBOUNCE is never
+// announced as gone, so reconnects don't spam the customer
+var agentPresenceDebounce = getEnvDuration("AGENT_PRESENCE_DEBOUNCE", 5*time.Second)
+
+// agentPresenceTracker remembers which chats have been told an agent is
+// present and holds the pending "left" announcement of each chat
+type agentPresenceTracker struct {
+	mu        sync.Mutex
+	announced map[string]bool
+	leaving   map[string]*time.Timer
+}
+
+var agentPresence = &agentPresenceTracker{
+	announced: make(map[string]bool),
+	leaving:   make(map[string]*time.Timer),
+}
+
+// Called after an admin socket of the chat is registered
+func (t *agentPresenceTracker) Joined(store ChatStore, chatID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if timer, ok := t.leaving[chatID]; ok {
+		timer.Stop()
+		delete(t.leaving, chatID)
+	}
+	if t.announced[chatID] {
+		return
+	}
+	t.announced[chatID] = true
+	go announceAgent(store, chatID, "An agent has joined the chat.")
+}
+
+// Called after an admin socket of the chat is removed
+func (t *agentPresenceTracker) Left(store ChatStore, chatID string) {
+	if registry.AdminCount(chatID) > 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.announced[chatID] || t.leaving[chatID] != nil {
+		return
+	}
+	t.leaving[chatID] = time.AfterFunc(agentPresenceDebounce, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.leaving, chatID)
+		// An agent may have reconnected while the timer was firing
+		if registry.AdminCount(chatID) > 0 {
+			return
+		}
+		delete(t.announced, chatID)
+		go announceAgent(store, chatID, "The agent has left.")
+	})
+}
+
+// Store a system message about the agent and send it to the chat
+func announceAgent(store ChatStore, chatID, text string) {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	saved, err := saveMessage(ctx, store, chatID, ChatMessage{
+		Sender:     "System",
+		SenderName: "System",
+		SenderRole: roleSystem,
+		Message:    text,
+		Timestamp:  time.Now().UTC(),
+	})
+	if errors.Is(err, errChatClosed) {
+		return
+	}
+	if err != nil {
+		slog.Error("Error saving agent presence message", "event", "agent_presence", "chatId", chatID, "error", err)
+		return
+	}
+	broadcastMessage(chatID, saved)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Chats keep at most MAX_INLINE_MESSAGES messages in their document; older ones
+// move to the archive collection. 0 (the default) keeps everything inline.
+var maxInlineMessages = getEnvInt("MAX_INLINE_MESSAGES", 0)
+
+// ArchivedMessage is a message moved out of its chat document. Index is its
+// position in the chat's full history, so paging can continue across the
+// archive and the live array.
+type ArchivedMessage struct {
+	ChatID      string `bson:"chatId"`
+	Index       int    `bson:"index"`
+	ChatMessage `bson:",inline"`
+}
+
+// Archiving leaves 90% of the cap inline so it doesn't run on every message
+func (s *mongoStore) ArchiveOverflow(ctx context.Context, chatID string, count int) error {
+	n := count - maxInlineMessages*9/10
+	if n <= 0 {
+		return nil
+	}
+
+	var chat Chat
+	projection := options.FindOne().SetProjection(bson.M{"messages": bson.M{"$slice": n}, "archivedCount": 1})
+	if err := s.chats.FindOne(ctx, bson.M{"chatId": chatID}, projection).Decode(&chat); err != nil {
+		return err
+	}
+	if len(chat.Messages) == 0 {
+		return nil
+	}
+
+	docs := make([]interface{}, len(chat.Messages))
+	for i, msg := range chat.Messages {
+		docs[i] = ArchivedMessage{ChatID: chatID, Index: chat.ArchivedCount + i, ChatMessage: msg}
+	}
+	// A concurrent archiver may have copied the same messages; the unique
+	// index makes the copy idempotent
+	_, err := s.archive.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+
+	// Drop the copied messages unless someone else already did
+	archived := len(chat.Messages)
+	filter := bson.M{"chatId": chatID, "archivedCount": chat.ArchivedCount}
+	if chat.ArchivedCount == 0 {
+		filter["archivedCount"] = bson.M{"$in": bson.A{nil, 0}}
+	}
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"messages":      bson.M{"$slice": bson.A{"$messages", archived, bson.M{"$max": bson.A{bson.M{"$size": "$messages"}, 1}}}},
+		"archivedCount": bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$archivedCount", 0}}, archived}},
+	}}}}
+	_, err = s.chats.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// The archive filter mirrors the history query
+func (s *mongoStore) ArchivedHistory(ctx context.Context, chatID string, query HistoryQuery) ([]ArchivedMessage, bool, error) {
+	filter := bson.M{"chatId": chatID}
+	if query.BeforeIndex != nil {
+		filter["index"] = bson.M{"$lt": *query.BeforeIndex}
+	} else if query.BeforeTime != nil {
+		filter["timestamp"] = bson.M{"$lt": *query.BeforeTime}
+	}
+	if query.Sender != "" {
+		filter["sender"] = query.Sender
+	}
+	if query.Role != "" {
+		filter["senderRole"] = query.Role
+	}
+
+	limit := query.Limit
+	opts := options.Find().
+		SetSort(bson.D{{Key: "index", Value: -1}}).
+		SetLimit(int64(limit + 1))
+	cursor, err := s.archive.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	defer cursor.Close(ctx)
+
+	var messages []ArchivedMessage
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, false, err
+	}
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, hasMore, nil
+}
+
+// An archived message of a chat whose field has the given value, or
+// mongo.ErrNoDocuments
+func (s *mongoStore) findArchivedMessage(ctx context.Context, chatID, field, value string) (ArchivedMessage, error) {
+	var archived ArchivedMessage
+	err := s.archive.FindOne(ctx, bson.M{"chatId": chatID, field: value}).Decode(&archived)
+	return archived, err
+}
+
+// Indexes for the archive collection
+func (s *mongoStore) ensureArchiveIndexes(ctx context.Context) error {
+	_, err := s.archive.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "chatId", Value: 1}, {Key: "index", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "chatId", Value: 1}, {Key: "msgId", Value: 1}}},
+		{Keys: bson.D{{Key: "chatId", Value: 1}, {Key: "clientMsgId", Value: 1}}, Options: options.Index().SetSparse(true)},
+	})
+	return err
+}
+
+// Archive a chat's overflow after a save, logging instead of failing the save
+func archiveIfNeeded(ctx context.Context, store ChatStore, chatID string, count int) {
+	if maxInlineMessages <= 0 || count <= maxInlineMessages {
+		return
+	}
+	if err := store.ArchiveOverflow(ctx, chatID, count); err != nil {
+		slog.Error("Error archiving messages", "event", "message_archive", "chatId", chatID, "error", err)
+	}
+}
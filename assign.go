@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// AssignmentEvent tells chat participants and the admin feed who owns a chat
+type AssignmentEvent struct {
+	Type       string    `json:"type"` // always "assigned"
+	ChatID     string    `json:"chatId"`
+	AssignedTo string    `json:"assignedTo"`
+	AssignedBy string    `json:"assignedBy"`
+	AssignedAt time.Time `json:"assignedAt"`
+}
+
+// Assign an active chat to an admin (admins only).
+// Reassigning a chat owned by someone else requires ?force=true.
+func assignChat(store ChatStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := authenticate(c.Request)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+		if !claims.IsAdmin() {
+			respondError(c, http.StatusForbidden, codeForbidden, "Admin role required")
+			return
+		}
+
+		chatID := c.Param("chatId")
+		if chatID == "" {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "chatId is required")
+			return
+		}
+		var body struct {
+			AdminEmail string `json:"adminEmail"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || strings.TrimSpace(body.AdminEmail) == "" {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "adminEmail is required")
+			return
+		}
+		adminEmail := strings.TrimSpace(body.AdminEmail)
+
+		var from []string
+		if c.Query("force") != "true" {
+			// Unassigned, or already assigned to the same admin
+			from = []string{"", adminEmail}
+		}
+		now := time.Now().UTC()
+
+		ctx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+
+		assigned, err := store.AssignChat(ctx, chatID, adminEmail, from, now)
+		if err != nil {
+			slog.Error("Error assigning chat", "event", "chat_assign", "chatId", chatID, "error", err)
+			respondDBError(c, err, "Could not assign chat")
+			return
+		}
+		if !assigned {
+			chat, err := store.GetChat(ctx, chatID)
+			if err == mongo.ErrNoDocuments {
+				respondError(c, http.StatusNotFound, codeChatNotFound, "chat not found")
+				return
+			}
+			if err != nil {
+				slog.Error("Database error while checking chat", "event", "chat_assign", "chatId", chatID, "error", err)
+				respondDBError(c, err, "Database error")
+				return
+			}
+			if chat.Status != "active" {
+				respondError(c, http.StatusConflict, codeChatClosed, "Chat is not active")
+				return
+			}
+			respondError(c, http.StatusConflict, codeChatAlreadyAssigned, "Chat is already assigned to "+chat.AssignedTo)
+			return
+		}
+
+		event := AssignmentEvent{
+			Type:       "assigned",
+			ChatID:     chatID,
+			AssignedTo: adminEmail,
+			AssignedBy: claims.Email,
+			AssignedAt: now,
+		}
+		broadcastEvent(chatID, event, nil)
+		broadcastAdminEvent(event)
+
+		respond(c, http.StatusOK, gin.H{"message": "Chat assigned successfully", "assignedTo": adminEmail})
+	}
+}
+
+// Hand an active chat from one admin to another, leaving a system message in
+// the transcript (admins only). from must be the current assignee unless
+// ?force=true.
+func transferChat(store ChatStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := authenticate(c.Request)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+		if !claims.IsAdmin() {
+			respondError(c, http.StatusForbidden, codeForbidden, "Admin role required")
+			return
+		}
+
+		chatID := c.Param("chatId")
+		var body struct {
+			From string `json:"from"`
+			To   string `json:"to"`
+			Note string `json:"note"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || strings.TrimSpace(body.To) == "" {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "to is required")
+			return
+		}
+		from := strings.TrimSpace(body.From)
+		to := strings.TrimSpace(body.To)
+		note := strings.TrimSpace(body.Note)
+		force := c.Query("force") == "true"
+		if from == "" && !force {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "from is required")
+			return
+		}
+		if from == to {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "from and to must differ")
+			return
+		}
+		// The note ends up in a transcript message, so it gets the same limit
+		if utf8.RuneCountInString(note) > maxMessageChars {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "note is too long")
+			return
+		}
+
+		ctx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+
+		chat, err := store.GetChat(ctx, chatID)
+		if err == mongo.ErrNoDocuments {
+			respondError(c, http.StatusNotFound, codeChatNotFound, "chat not found")
+			return
+		}
+		if err != nil {
+			slog.Error("Database error while fetching chat", "event", "chat_transfer", "chatId", chatID, "error", err)
+			respondDBError(c, err, "Database error")
+			return
+		}
+		if chat.Status != "active" {
+			respondError(c, http.StatusConflict, codeChatClosed, "Chat is not active")
+			return
+		}
+		if force {
+			from = chat.AssignedTo
+		}
+
+		// Matching on the assignee keeps a concurrent reassignment from being overwritten
+		now := time.Now().UTC()
+		transferred, err := store.AssignChat(ctx, chatID, to, []string{from}, now)
+		if err != nil {
+			slog.Error("Error transferring chat", "event", "chat_transfer", "chatId", chatID, "error", err)
+			respondDBError(c, err, "Could not transfer chat")
+			return
+		}
+		if !transferred {
+			respondError(c, http.StatusConflict, codeAssigneeMismatch, "Chat is not assigned to "+from)
+			return
+		}
+
+		text := "Chat transferred to " + to + "."
+		if from != "" {
+			text = "Chat transferred from " + from + " to " + to + "."
+		}
+		if note != "" {
+			text += " Note: " + note
+		}
+		notice, err := saveMessage(ctx, store, chatID, ChatMessage{
+			Sender:     "System",
+			SenderName: "System",
+			SenderRole: roleSystem,
+			Message:    text,
+			Timestamp:  now,
+		})
+		if err != nil {
+			// The transfer itself went through
+			slog.Error("Error saving transfer notice", "event", "chat_transfer", "chatId", chatID, "error", err)
+		} else {
+			broadcastMessage(chatID, notice)
+		}
+
+		event := AssignmentEvent{
+			Type:       "assigned",
+			ChatID:     chatID,
+			AssignedTo: to,
+			AssignedBy: claims.Email,
+			AssignedAt: now,
+		}
+		broadcastEvent(chatID, event, nil)
+		broadcastAdminEvent(event)
+
+		slog.Info("Chat transferred", "event", "chat_transfer", "chatId", chatID, "from", from, "to", to, "by", claims.Email, "forced", force)
+		respond(c, http.StatusOK, gin.H{"message": "Chat transferred successfully", "from": from, "assignedTo": to})
+	}
+}
+
+func (s *mongoStore) AssignChat(ctx context.Context, chatID, to string, from []string, at time.Time) (bool, error) {
+	filter := bson.M{"chatId": chatID, "status": "active"}
+	if from != nil {
+		assignees := bson.A{}
+		for _, assignee := range from {
+			if assignee == "" {
+				assignees = append(assignees, nil, "")
+			} else {
+				assignees = append(assignees, assignee)
+			}
+		}
+		filter["assignedTo"] = bson.M{"$in": assignees}
+	}
+	update := bson.M{"$set": bson.M{"assignedTo": to, "assignedAt": at}}
+
+	result, err := s.chats.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTransferChatNoteLength(t *testing.T) {
+	tests := []struct {
+		name       string
+		note       string
+		wantStatus int
+	}{
+		{"short note", "customer asked for billing", http.StatusOK},
+		{"note at the limit", strings.Repeat("ы", maxMessageChars), http.StatusOK},
+		{"note too long", strings.Repeat("ы", maxMessageChars+1), http.StatusBadRequest},
+	}
+
+	token := testToken(t, Claims{Email: "lead@example.com", Role: roleAdmin})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			store.addChat(Chat{ChatID: "c1", UserEmail: "user@example.com", AssignedTo: "agent@example.com"})
+
+			body := strings.NewReader(`{"from":"agent@example.com","to":"other@example.com","note":"` + tt.note + `"}`)
+			w := serve(http.MethodPost, "/chat/:chatId/transfer", "/chat/c1/transfer", body, token, transferChat(store))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			chat, _ := store.chat("c1")
+			if transferred := chat.AssignedTo == "other@example.com"; transferred != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("assignedTo = %s after status %d", chat.AssignedTo, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Claims carried by the bearer token
+type Claims struct {
+	Email     string `json:"email"`
+	Name      string `json:"name,omitempty"`
+	Role      string `json:"role,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Whether the token belongs to an admin
+func (c *Claims) IsAdmin() bool {
+	return c.Role == roleAdmin
+}
+
+// Whether the token is a generated guest identity
+func (c *Claims) IsGuest() bool {
+	return c.Role == roleGuest
+}
+
+// Name shown on the user's messages, the email when the token has none.
+// Guests are never shown by their generated ID.
+func (c *Claims) DisplayName() string {
+	switch {
+	case c.Name != "":
+		return c.Name
+	case c.IsGuest():
+		return "Guest"
+	default:
+		return c.Email
+	}
+}
+
+// Role stored on the messages this user sends. Integrations authenticate
+// with the system role; anyone who isn't staff is a customer.
+func (c *Claims) SenderRole() string {
+	switch c.Role {
+	case roleAdmin, roleSystem:
+		return c.Role
+	default:
+		return roleCustomer
+	}
+}
+
+var (
+	errMissingToken = errors.New("missing token")
+	errInvalidToken = errors.New("invalid token")
+	errExpiredToken = errors.New("token expired")
+)
+
+// HMAC secret used to verify tokens (JWT_SECRET)
+var jwtSecret = []byte(os.Getenv("JWT_SECRET"))
+
+// Authenticate a request by the bearer token in the Authorization header or
+// the "token" query parameter (browsers can't set headers on a WebSocket upgrade)
+func authenticate(r *http.Request) (*Claims, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		return nil, errMissingToken
+	}
+	return parseToken(token, jwtSecret)
+}
+
+// Verify an HS256 JWT and return its claims
+func parseToken(token string, secret []byte) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return nil, errInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errInvalidToken
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil || claims.Email == "" || claims.ExpiresAt == 0 {
+		return nil, errInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errExpiredToken
+	}
+	return &claims, nil
+}
+
+// Issue an HS256 JWT for the claims
+func signToken(claims *Claims, secret []byte) (string, error) {
+	header, err := encodeSegment(map[string]string{"alg": "HS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := encodeSegment(claims)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(header + "." + payload))
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Encode a value as a base64url JSON segment of a JWT
+func encodeSegment(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Decode a base64url JSON segment of a JWT
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
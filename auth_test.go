@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseToken(t *testing.T) {
+	valid := testToken(t, Claims{Email: "user@example.com"})
+	parts := strings.Split(valid, ".")
+	forged, _ := encodeSegment(Claims{Email: "user@example.com", Role: roleAdmin, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	none, _ := encodeSegment(map[string]string{"alg": "none"})
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"valid", valid, nil},
+		{"expired", testToken(t, Claims{Email: "user@example.com", ExpiresAt: time.Now().Add(-time.Minute).Unix()}), errExpiredToken},
+		{"payload swapped for an admin one", parts[0] + "." + forged + "." + parts[2], errInvalidToken},
+		{"signature altered", parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString([]byte("not the signature")), errInvalidToken},
+		{"unsigned", none + "." + parts[1] + ".", errInvalidToken},
+		{"signed with another secret", signedWith(t, Claims{Email: "user@example.com", ExpiresAt: time.Now().Add(time.Hour).Unix()}, "other-secret"), errInvalidToken},
+		{"without an expiry", signedWith(t, Claims{Email: "user@example.com"}, string(jwtSecret)), errInvalidToken},
+		{"malformed", "not-a-token", errInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := parseToken(tt.token, jwtSecret)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (claims.Email != "user@example.com" || claims.IsAdmin()) {
+				t.Errorf("claims = %+v", claims)
+			}
+		})
+	}
+}
+
+func signedWith(t *testing.T, claims Claims, secret string) string {
+	t.Helper()
+	token, err := signToken(&claims, []byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAuthenticateTokenSources(t *testing.T) {
+	token := testToken(t, Claims{Email: "user@example.com"})
+
+	tests := []struct {
+		name    string
+		header  string
+		query   string
+		wantErr error
+	}{
+		{"bearer header", "Bearer " + token, "", nil},
+		{"query parameter", "", "?token=" + token, nil},
+		{"missing", "", "", errMissingToken},
+		{"expired", "Bearer " + testToken(t, Claims{Email: "user@example.com", ExpiresAt: time.Now().Add(-time.Second).Unix()}), "", errExpiredToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/ws"+tt.query, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if _, err := authenticate(req); !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConnectRejectsBadTokens(t *testing.T) {
+	valid := testToken(t, Claims{Email: "user@example.com"})
+	parts := strings.Split(valid, ".")
+	forged, _ := encodeSegment(Claims{Email: "agent@example.com", Role: roleAdmin, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"expired", testToken(t, Claims{Email: "user@example.com", ExpiresAt: time.Now().Add(-time.Minute).Unix()})},
+		{"tampered", parts[0] + "." + forged + "." + parts[2]},
+	}
+
+	store := newFakeStore()
+	url := startWS(t, store)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{"Authorization": {"Bearer " + tt.token}}
+			ws, resp, err := websocket.DefaultDialer.Dial(url, header)
+			if err == nil {
+				ws.Close()
+				t.Fatal("connection was upgraded")
+			}
+			if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("response = %v, want 401", resp)
+			}
+		})
+	}
+}
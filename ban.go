@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Ban is a user barred from connecting
+type Ban struct {
+	UserEmail string    `bson:"_id" json:"userEmail"`
+	Reason    string    `bson:"reason,omitempty" json:"reason,omitempty"`
+	BannedBy  string    `bson:"bannedBy" json:"bannedBy"`
+	BannedAt  time.Time `bson:"bannedAt" json:"bannedAt"`
+}
+
+// BanStore keeps the users barred from connecting
+type BanStore interface {
+	// The user's ban, or nil when they aren't banned
+	FindBan(ctx context.Context, userEmail string) (*Ban, error)
+
+	// Store a ban, replacing any earlier one of the same user
+	SaveBan(ctx context.Context, ban Ban) error
+
+	// Lift a user's ban; false when they weren't banned
+	DeleteBan(ctx context.Context, userEmail string) (bool, error)
+}
+
+func (s *mongoStore) FindBan(ctx context.Context, userEmail string) (*Ban, error) {
+	var ban Ban
+	err := s.bans.FindOne(ctx, bson.M{"_id": userEmail}).Decode(&ban)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ban, nil
+}
+
+func (s *mongoStore) SaveBan(ctx context.Context, ban Ban) error {
+	_, err := s.bans.ReplaceOne(ctx, bson.M{"_id": ban.UserEmail}, ban, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *mongoStore) DeleteBan(ctx context.Context, userEmail string) (bool, error) {
+	result, err := s.bans.DeleteOne(ctx, bson.M{"_id": userEmail})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+// Ban a user and drop their live connections (admins only)
+func banUser(bans BanStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := authenticate(c.Request)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+		if !claims.IsAdmin() {
+			respondError(c, http.StatusForbidden, codeForbidden, "Admin role required")
+			return
+		}
+
+		var body struct {
+			UserEmail string `json:"userEmail"`
+			Reason    string `json:"reason"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || body.UserEmail == "" {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "userEmail is required")
+			return
+		}
+		if body.UserEmail == claims.Email {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "You can't ban yourself")
+			return
+		}
+
+		ban := Ban{
+			UserEmail: body.UserEmail,
+			Reason:    body.Reason,
+			BannedBy:  claims.Email,
+			BannedAt:  time.Now().UTC(),
+		}
+
+		ctx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+
+		if err := bans.SaveBan(ctx, ban); err != nil {
+			slog.Error("Error banning user", "event", "user_ban", "userEmail", ban.UserEmail, "error", err)
+			respondDBError(c, err, "Could not ban user")
+			return
+		}
+
+		disconnected := len(disconnectUser(ban.UserEmail, closeBanned, "banned"))
+		slog.Info("User banned", "event", "user_ban", "userEmail", ban.UserEmail, "bannedBy", claims.Email, "disconnected", disconnected)
+
+		respond(c, http.StatusOK, gin.H{"ban": ban, "disconnected": disconnected})
+	}
+}
+
+// Lift a user's ban (admins only)
+func unbanUser(bans BanStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := authenticate(c.Request)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+		if !claims.IsAdmin() {
+			respondError(c, http.StatusForbidden, codeForbidden, "Admin role required")
+			return
+		}
+		userEmail := c.Param("userEmail")
+
+		ctx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+
+		deleted, err := bans.DeleteBan(ctx, userEmail)
+		if err != nil {
+			slog.Error("Error unbanning user", "event", "user_unban", "userEmail", userEmail, "error", err)
+			respondDBError(c, err, "Could not unban user")
+			return
+		}
+		if !deleted {
+			respondError(c, http.StatusNotFound, codeUserNotBanned, "user is not banned")
+			return
+		}
+
+		slog.Info("User unbanned", "event", "user_unban", "userEmail", userEmail, "unbannedBy", claims.Email)
+		respond(c, http.StatusOK, gin.H{"message": "User unbanned"})
+	}
+}
+
+// Close a single connection, or every connection of a user (admins only)
+func forceDisconnect(c *gin.Context) {
+	claims, err := authenticate(c.Request)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+	if !claims.IsAdmin() {
+		respondError(c, http.StatusForbidden, codeForbidden, "Admin role required")
+		return
+	}
+
+	var body struct {
+		ConnectionID string `json:"connectionId"`
+		UserEmail    string `json:"userEmail"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || (body.ConnectionID == "") == (body.UserEmail == "") {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "Exactly one of connectionId or userEmail is required")
+		return
+	}
+
+	closed := []ConnectionInfo{}
+	if body.ConnectionID != "" {
+		if info, ok := disconnectConnection(body.ConnectionID, closeKicked, "disconnected by admin"); ok {
+			closed = append(closed, info)
+		}
+	} else {
+		closed = disconnectUser(body.UserEmail, closeKicked, "disconnected by admin")
+	}
+
+	slog.Info("Connections force-closed", "event", "ws_force_disconnect", "connectionId", body.ConnectionID, "userEmail", body.UserEmail, "by", claims.Email, "disconnected", len(closed))
+	respond(c, http.StatusOK, gin.H{"disconnected": len(closed), "connections": closed})
+}
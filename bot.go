@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Responder produces automated replies to a customer message.
+// It may return no replies; Sender and SenderRole are filled in by the server.
+type Responder interface {
+	Respond(ctx context.Context, chatID string, msg ChatMessage) []ChatMessage
+}
+
+// The auto-responder is off unless BOT_ENABLED=true
+var botResponder Responder = newBotResponder(getEnv("BOT_ENABLED", "false") == "true")
+
+func newBotResponder(enabled bool) Responder {
+	if !enabled {
+		return nil
+	}
+	return keywordResponder{rules: defaultBotRules}
+}
+
+// BotRule answers messages containing any of its keywords
+type BotRule struct {
+	Keywords []string
+	Reply    string
+}
+
+// FAQ answers used by the default keyword responder
+var defaultBotRules = []BotRule{
+	{Keywords: []string{"refund", "money back"}, Reply: "Refunds are processed within 5-7 business days. An agent will confirm the details with you."},
+	{Keywords: []string{"password", "log in", "login"}, Reply: "You can reset your password from the login page using \"Forgot password\"."},
+	{Keywords: []string{"hours", "open", "working time"}, Reply: "Our support team is available every day from 9:00 to 21:00."},
+}
+
+// keywordResponder replies with the first rule whose keyword appears in the message
+type keywordResponder struct {
+	rules []BotRule
+}
+
+func (k keywordResponder) Respond(_ context.Context, _ string, msg ChatMessage) []ChatMessage {
+	text := strings.ToLower(msg.Message)
+	for _, rule := range k.rules {
+		for _, keyword := range rule.Keywords {
+			if strings.Contains(text, keyword) {
+				return []ChatMessage{{Message: rule.Reply}}
+			}
+		}
+	}
+	return nil
+}
+
+// Run the responder for a customer message and post its replies as the bot.
+// Called in its own goroutine so the read loop never waits on it.
+func runBot(store ChatStore, chatID string, msg ChatMessage) {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	replies := botResponder.Respond(ctx, chatID, msg)
+	if len(replies) == 0 {
+		return
+	}
+
+	// The chat may have been closed while the message was in flight
+	chat, err := store.GetChat(ctx, chatID)
+	if err != nil {
+		slog.Error("Error fetching chat for bot reply", "event", "bot_reply", "chatId", chatID, "error", err)
+		return
+	}
+	if chat.Status != "active" {
+		return
+	}
+
+	for _, reply := range replies {
+		reply.Sender = "Bot"
+		reply.SenderName = "Bot"
+		reply.SenderRole = roleBot
+		reply.Timestamp = time.Now().UTC()
+		saved, err := saveMessage(ctx, store, chatID, reply)
+		if err != nil {
+			return
+		}
+		broadcastMessage(chatID, saved)
+	}
+}
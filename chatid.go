@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Chat IDs must be canonical UUIDs, like the ones the server generates, unless
+// CHAT_ID_PATTERN supplies a regular expression to accept instead
+var chatIDPattern = compileChatIDPattern(getEnv("CHAT_ID_PATTERN", ""))
+
+func compileChatIDPattern(pattern string) *regexp.Regexp {
+	if pattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		log.Fatalf("Invalid CHAT_ID_PATTERN=%q: %v", pattern, err)
+	}
+	return re
+}
+
+// Whether a client-supplied chat ID is well formed
+func validChatID(chatID string) bool {
+	if chatIDPattern != nil {
+		return chatIDPattern.MatchString(chatID)
+	}
+	// uuid.Parse also accepts urn and braced forms, only take the 36-char one
+	_, err := uuid.Parse(chatID)
+	return err == nil && len(chatID) == 36
+}
+
+// Reject requests whose :chatId route parameter is malformed
+func chatIDParamValidator(c *gin.Context) {
+	if chatID := c.Param("chatId"); chatID != "" && !validChatID(chatID) {
+		abortWithError(c, http.StatusBadRequest, codeInvalidChatID, "invalid chatId")
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestValidChatID(t *testing.T) {
+	tests := []struct {
+		chatID string
+		want   bool
+	}{
+		{testChatID, true},
+		{strings.ToUpper(testChatID), true},
+		{"", false},
+		{"c1", false},
+		{"3f2b8c1e6a0d4e5f9b7a2c4d6e8f0a1b", false}, // No hyphens
+		{"{" + testChatID + "}", false},
+		{"urn:uuid:" + testChatID, false},
+		{testChatID + "0", false},
+		{"3f2b8c1e-6a0d-4e5f-9b7a-2c4d6e8f0a1g", false},
+		{"../../etc/passwd", false},
+	}
+	for _, tt := range tests {
+		if got := validChatID(tt.chatID); got != tt.want {
+			t.Errorf("validChatID(%q) = %v, want %v", tt.chatID, got, tt.want)
+		}
+	}
+}
+
+func TestValidChatIDCustomPattern(t *testing.T) {
+	defer func(pattern *regexp.Regexp) { chatIDPattern = pattern }(chatIDPattern)
+	chatIDPattern = compileChatIDPattern("[a-z]+-[0-9]+")
+
+	for chatID, want := range map[string]bool{
+		"ticket-42":   true,
+		"ticket-":     false,
+		"xticket-42!": false, // The pattern must match the whole ID
+		testChatID:    false,
+	} {
+		if got := validChatID(chatID); got != want {
+			t.Errorf("validChatID(%q) = %v, want %v", chatID, got, want)
+		}
+	}
+}
+
+func TestChatIDParamValidator(t *testing.T) {
+	router := gin.New()
+	router.Use(chatIDParamValidator)
+	router.GET("/chat/:chatId", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	router.GET("/chats", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{"/chat/" + testChatID, http.StatusNoContent},
+		{"/chat/c1", http.StatusBadRequest},
+		{"/chat/%7B" + testChatID + "%7D", http.StatusBadRequest},
+		{"/chats", http.StatusNoContent}, // No :chatId to check
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.wantStatus {
+			t.Errorf("GET %s status = %d, want %d", tt.path, w.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus == http.StatusBadRequest {
+			if apiErr := decodeEnvelope(t, w, nil); apiErr == nil || apiErr.Code != codeInvalidChatID {
+				t.Errorf("GET %s error = %+v, want %s", tt.path, apiErr, codeInvalidChatID)
+			}
+		}
+	}
+}
+
+func TestConnectRejectsInvalidChatID(t *testing.T) {
+	store := newFakeStore()
+	url := startWS(t, store)
+
+	ws := dialChat(t, url, Claims{Email: "user@example.com"}, map[string]string{"chatId": "not-a-chat-id"})
+	if frame := readFrame(t, ws, "error"); frame["error"] != "invalid chatId" {
+		t.Errorf("error = %v, want invalid chatId", frame["error"])
+	}
+	if code := readCloseCode(t, ws); code != closeInvalidRequest {
+		t.Errorf("close code = %d, want %d", code, closeInvalidRequest)
+	}
+	if chatID, _ := store.ActiveChatID(context.Background(), "user@example.com"); chatID != "" {
+		t.Errorf("created chat %s for an invalid chatId", chatID)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Application close codes (4000-4999) sent when the server ends a connection,
+// so clients can react without parsing the preceding message
+const (
+	closeInvalidRequest   = 4000 // Bad init message or chatId
+	closeForbidden        = 4003 // Authenticated but not allowed, e.g. admin-only feed
+	closeChatEnded        = 4004 // The chat is closed
+	closeBanned           = 4008 // The user is banned
+	closeActiveChatExists = 4009 // The user already has another active chat
+	closeKicked           = 4010 // Disconnected by an admin
+	closeRateLimited      = 4029 // Too many frames
+)
+
+// Send a close frame with a code and short reason; the caller closes the socket
+func closeWithCode(ws *websocket.Conn, code int, reason string) {
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+}
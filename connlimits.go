@@ -0,0 +1,14 @@
+package main
+
+import "errors"
+
+// Caps on simultaneous WebSocket connections; 0 disables a cap
+var (
+	maxConnections        = getEnvInt("MAX_CONNECTIONS", 10000)
+	maxConnectionsPerUser = getEnvInt("MAX_CONNECTIONS_PER_USER", 10)
+)
+
+var (
+	errServerFull        = errors.New("server is at its connection limit")
+	errUserConnectionCap = errors.New("too many open connections for this user")
+)
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/gin-contrib/cors"
+)
+
+// Build the CORS config for the REST API from CORS_ORIGINS, CORS_METHODS,
+// CORS_HEADERS and CORS_ALLOW_CREDENTIALS. Without CORS_ORIGINS every origin
+// is allowed, same as cors.Default().
+func corsConfig() cors.Config {
+	config := cors.DefaultConfig()
+	// REST write endpoints take a bearer token, admin routes may take a shared token
+	config.AllowHeaders = append(config.AllowHeaders, "Authorization", adminTokenHeader)
+
+	if origins := getEnvList("CORS_ORIGINS"); len(origins) > 0 {
+		config.AllowOrigins = origins
+	} else {
+		config.AllowAllOrigins = true
+	}
+	if methods := getEnvList("CORS_METHODS"); len(methods) > 0 {
+		config.AllowMethods = methods
+	}
+	if headers := getEnvList("CORS_HEADERS"); len(headers) > 0 {
+		config.AllowHeaders = headers
+	}
+	// Credentials can't be combined with a wildcard origin
+	config.AllowCredentials = getEnv("CORS_ALLOW_CREDENTIALS", "false") == "true" && !config.AllowAllOrigins
+	return config
+}
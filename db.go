@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Deadline for a single database operation (DB_TIMEOUT)
+var dbTimeout = getEnvDuration("DB_TIMEOUT", 5*time.Second)
+
+// Bound database work derived from a request's context
+func dbContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, dbTimeout)
+}
+
+// Whether a database call failed because it ran out of time
+func isTimeout(err error) bool {
+	return mongo.IsTimeout(err) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// HTTP status for a failed database call: 504 when it timed out, 500 otherwise
+func dbErrorStatus(err error) int {
+	if isTimeout(err) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSaveMessageDeduplicatesClientMsgID(t *testing.T) {
+	store := newFakeStore()
+	store.addChat(Chat{ChatID: "c1", UserEmail: "user@example.com"})
+	msg := ChatMessage{Sender: "user@example.com", Message: "hello", ClientMsgID: "c-1"}
+
+	first, err := saveMessage(context.Background(), store, "c1", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := saveMessage(context.Background(), store, "c1", msg)
+	if !errors.Is(err, errDuplicateMessage) {
+		t.Errorf("second save error = %v, want errDuplicateMessage", err)
+	}
+	if second.MsgID != first.MsgID {
+		t.Errorf("second save returned %s, want the first copy %s", second.MsgID, first.MsgID)
+	}
+	if chat, _ := store.chat("c1"); len(chat.Messages) != 1 {
+		t.Errorf("stored %d messages, want 1", len(chat.Messages))
+	}
+}
+
+func TestPostMessageTwicePersistsOnce(t *testing.T) {
+	useTestRegistry(t)
+	store := newFakeStore()
+	store.addChat(Chat{ChatID: "c1", UserEmail: "user@example.com"})
+	token := testToken(t, Claims{Email: "user@example.com"})
+
+	var ids []string
+	for _, wantStatus := range []int{http.StatusCreated, http.StatusOK} {
+		body := strings.NewReader(`{"message":"hello","clientMsgId":"c-1"}`)
+		w := serve(http.MethodPost, "/chat/:chatId/message", "/chat/c1/message", body, token, postMessage(store))
+		if w.Code != wantStatus {
+			t.Fatalf("status = %d, want %d: %s", w.Code, wantStatus, w.Body)
+		}
+		var msg ChatMessage
+		decodeEnvelope(t, w, &msg)
+		ids = append(ids, msg.MsgID)
+	}
+	if ids[0] == "" || ids[0] != ids[1] {
+		t.Errorf("message IDs = %v, want the same ID twice", ids)
+	}
+	if chat, _ := store.chat("c1"); len(chat.Messages) != 1 {
+		t.Errorf("stored %d messages, want 1", len(chat.Messages))
+	}
+}
+
+func TestSendSameClientMsgIDTwiceOverWebSocket(t *testing.T) {
+	store := newFakeStore()
+	store.addChat(Chat{ChatID: testChatID, UserEmail: "user@example.com"})
+	ws := dialChat(t, startWS(t, store), Claims{Email: "user@example.com"}, map[string]string{"chatId": testChatID})
+	readFrame(t, ws, "init")
+
+	var ids []interface{}
+	for i := 0; i < 2; i++ {
+		ws.WriteJSON(map[string]string{"type": "message", "message": "hello", "clientMsgId": "c-1"})
+		ids = append(ids, readFrame(t, ws, "ack")["msgId"])
+	}
+	if ids[0] == nil || ids[0] != ids[1] {
+		t.Errorf("acked message IDs = %v, want the same ID twice", ids)
+	}
+	if chat, _ := store.chat(testChatID); len(chat.Messages) != 1 {
+		t.Errorf("stored %d messages, want 1", len(chat.Messages))
+	}
+}
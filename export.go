@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Content types of the transcript export formats
+var exportContentTypes = map[string]string{
+	"json": "application/json; charset=utf-8",
+	"txt":  "text/plain; charset=utf-8",
+	"csv":  "text/csv; charset=utf-8",
+}
+
+// Download the full transcript of a chat as ?format=json (default), txt or csv.
+// Messages are streamed from a cursor one at a time, so long chats are never
+// held in memory whole.
+func exportChat(store ChatStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		chatID := c.Param("chatId")
+		format := c.DefaultQuery("format", "json")
+		contentType, ok := exportContentTypes[format]
+		if !ok {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "format must be json, txt or csv")
+			return
+		}
+
+		ctx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+
+		_, err := store.GetChat(ctx, chatID)
+		if err == mongo.ErrNoDocuments {
+			respondError(c, http.StatusNotFound, codeChatNotFound, "chat not found")
+			return
+		}
+		if err != nil {
+			slog.Error("Database error while fetching chat", "event", "chat_export", "chatId", chatID, "error", err)
+			respondDBError(c, err, "Database error")
+			return
+		}
+
+		// Headers go out with the first message, so a failure to start the
+		// export can still be answered with an error
+		var write func(*ChatMessage) error
+		start := func() {
+			c.Header("Content-Type", contentType)
+			c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="chat-%s.%s"`, chatID, format))
+			c.Status(http.StatusOK)
+			write = exportWriter(c, format)
+		}
+		var writeErr error
+
+		// The stream may outlast the usual query timeout, so it only ends with the request
+		err = store.ExportMessages(c.Request.Context(), chatID, func(msg ChatMessage) error {
+			if write == nil {
+				start()
+			}
+			writeErr = write(&msg)
+			return writeErr
+		})
+		switch {
+		case writeErr != nil:
+			slog.Warn("Transcript export aborted", "event", "chat_export", "chatId", chatID, "error", writeErr)
+			return
+		case err != nil && write == nil:
+			slog.Error("Database error while exporting chat", "event", "chat_export", "chatId", chatID, "error", err)
+			respondDBError(c, err, "Database error")
+			return
+		case err != nil:
+			// Headers are already sent, the truncated file is all we can do
+			slog.Error("Database error while exporting chat", "event", "chat_export", "chatId", chatID, "error", err)
+		}
+		if write == nil {
+			start()
+		}
+		write(nil)
+	}
+}
+
+func (s *mongoStore) ExportMessages(ctx context.Context, chatID string, fn func(ChatMessage) error) error {
+	archived, err := s.archive.Find(ctx, bson.M{"chatId": chatID}, options.Find().SetSort(bson.M{"index": 1}))
+	if err != nil {
+		return err
+	}
+	defer archived.Close(ctx)
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"chatId": chatID}}},
+		{{Key: "$unwind", Value: "$messages"}},
+		{{Key: "$replaceRoot", Value: bson.M{"newRoot": "$messages"}}},
+	}
+	cursor, err := s.chats.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	// Archived messages are older than everything still in the chat document
+	for _, source := range []*mongo.Cursor{archived, cursor} {
+		if err := forEachMessage(ctx, source, chatID, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pass each message of a cursor to fn. Undecodable messages are skipped; an
+// error from fn or the cursor ends the iteration and is returned.
+func forEachMessage(ctx context.Context, cursor *mongo.Cursor, chatID string, fn func(ChatMessage) error) error {
+	for cursor.Next(ctx) {
+		var msg ChatMessage
+		if err := cursor.Decode(&msg); err != nil {
+			slog.Error("Error decoding message", "event", "chat_export", "chatId", chatID, "error", err)
+			continue
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// A message's text in the plain-text formats: deleted messages show a
+// placeholder, attachments are listed by URL
+func exportText(msg *ChatMessage) string {
+	text := msg.Message
+	if msg.Deleted {
+		text = "(message deleted)"
+	}
+	for _, a := range msg.Attachments {
+		text += " [attachment: " + a.URL + "]"
+	}
+	return text
+}
+
+// Return a function that writes one message in the given format; a nil
+// message finishes the file
+func exportWriter(c *gin.Context, format string) func(*ChatMessage) error {
+	switch format {
+	case "txt":
+		return func(msg *ChatMessage) error {
+			if msg == nil {
+				return nil
+			}
+			_, err := fmt.Fprintf(c.Writer, "[%s] %s: %s\n", msg.Timestamp.Format(time.RFC3339), msg.Sender, exportText(msg))
+			return err
+		}
+	case "csv":
+		w := csv.NewWriter(c.Writer)
+		w.Write([]string{"timestamp", "sender", "role", "message"})
+		return func(msg *ChatMessage) error {
+			if msg != nil {
+				w.Write([]string{msg.Timestamp.Format(time.RFC3339), msg.Sender, msg.SenderRole, exportText(msg)})
+			}
+			w.Flush()
+			return w.Error()
+		}
+	default:
+		// A JSON array written element by element
+		enc := json.NewEncoder(c.Writer)
+		first := true
+		return func(msg *ChatMessage) error {
+			if msg == nil {
+				if first {
+					c.Writer.WriteString("[")
+				}
+				_, err := c.Writer.WriteString("]\n")
+				return err
+			}
+			sep := ","
+			if first {
+				sep = "["
+				first = false
+			}
+			if _, err := c.Writer.WriteString(sep); err != nil {
+				return err
+			}
+			return enc.Encode(msg)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestExportChatPlainText(t *testing.T) {
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	chat := testChat("c1", 3, base)
+	chat.Messages[1].Message = "something rude"
+	chat.Messages[1].Deleted = true
+	chat.Messages[2].Attachments = []Attachment{{URL: "https://cdn.example.com/c1/receipt.png"}}
+
+	tests := []struct {
+		format string
+		want   []string // The text of each message, in order
+	}{
+		{"txt", []string{"message 0", "(message deleted)", "message 2 [attachment: https://cdn.example.com/c1/receipt.png]"}},
+		{"csv", []string{"message 0", "(message deleted)", "message 2 [attachment: https://cdn.example.com/c1/receipt.png]"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			store := newFakeStore()
+			store.addChat(chat)
+
+			w := serve(http.MethodGet, "/chat/:chatId/export", "/chat/c1/export?format="+tt.format, nil, "", exportChat(store))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+			}
+			var got []string
+			if tt.format == "csv" {
+				records, err := csv.NewReader(w.Body).ReadAll()
+				if err != nil {
+					t.Fatalf("parsing csv: %v", err)
+				}
+				for _, record := range records[1:] {
+					got = append(got, record[3])
+				}
+			} else {
+				for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+					got = append(got, line[strings.Index(line, ": ")+2:])
+				}
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("messages = %q, want %q", got, tt.want)
+			}
+			if strings.Contains(w.Body.String(), "something rude") {
+				t.Error("export includes the deleted message's text")
+			}
+		})
+	}
+}
+
+func TestForEachMessage(t *testing.T) {
+	cursorErr := errors.New("cursor killed")
+	docs := []interface{}{
+		bson.M{"msgId": "m0", "message": "first"},
+		bson.M{"msgId": 42}, // Doesn't decode, skipped
+		bson.M{"msgId": "m2", "message": "third"},
+	}
+
+	tests := []struct {
+		name      string
+		cursorErr error
+		want      string
+	}{
+		{"skips undecodable messages", nil, "m0,m2"},
+		{"cursor error", cursorErr, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cursor, err := mongo.NewCursorFromDocuments(docs, tt.cursorErr, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			err = forEachMessage(context.Background(), cursor, "c1", func(msg ChatMessage) error {
+				got = append(got, msg.MsgID)
+				return nil
+			})
+			if !errors.Is(err, tt.cursorErr) {
+				t.Errorf("error = %v, want %v", err, tt.cursorErr)
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("messages = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// Export stops with a cursor error after the given number of messages
+type failingExportStore struct {
+	*fakeStore
+	after int
+}
+
+func (s failingExportStore) ExportMessages(ctx context.Context, chatID string, fn func(ChatMessage) error) error {
+	chat, _ := s.chat(chatID)
+	for _, msg := range chat.Messages[:s.after] {
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return errors.New("cursor killed")
+}
+
+func TestExportChatCursorError(t *testing.T) {
+	tests := []struct {
+		name       string
+		after      int
+		wantStatus int
+		wantLines  int
+	}{
+		{"before the first message", 0, http.StatusInternalServerError, 0},
+		{"mid-stream", 2, http.StatusOK, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := failingExportStore{fakeStore: newFakeStore(), after: tt.after}
+			store.addChat(testChat("c1", 5, time.Now()))
+
+			w := serve(http.MethodGet, "/chat/:chatId/export", "/chat/c1/export?format=txt", nil, "", exportChat(store))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if lines := strings.Count(w.Body.String(), "\n"); lines != tt.wantLines {
+				t.Errorf("exported %d lines, want the %d before the error", lines, tt.wantLines)
+			}
+		})
+	}
+}
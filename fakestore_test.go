@@ -0,0 +1,1076 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// fakeStore keeps chats, bans and scheduled messages in memory with the same
+// semantics as mongoStore, so handlers can be tested without a cluster
+type fakeStore struct {
+	mu        sync.Mutex
+	chats     map[string]*fakeChat
+	bans      map[string]Ban
+	scheduled map[string]ScheduledMessage
+
+	// Returned by every call while set, to exercise database failures
+	err error
+
+	// Returned by AppendMessage alone while set
+	appendErr error
+}
+
+// fakeChat is a chat document with its live messages plus its archive
+type fakeChat struct {
+	Chat
+	Seq      int64
+	Archived []ArchivedMessage
+}
+
+var (
+	_ ChatStore     = (*fakeStore)(nil)
+	_ BanStore      = (*fakeStore)(nil)
+	_ ScheduleStore = (*fakeStore)(nil)
+)
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		chats:     make(map[string]*fakeChat),
+		bans:      make(map[string]Ban),
+		scheduled: make(map[string]ScheduledMessage),
+	}
+}
+
+// Add a chat as stored, with its messages numbered in order
+func (f *fakeStore) addChat(chat Chat) *fakeChat {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if chat.Status == "" {
+		chat.Status = "active"
+	}
+	stored := &fakeChat{Chat: chat}
+	stored.Messages = nil
+	for _, msg := range chat.Messages {
+		stored.Seq++
+		msg.Seq = stored.Seq
+		stored.Messages = append(stored.Messages, msg)
+		stored.LastMessage = msg
+		stored.LastMessageTime = msg.Timestamp
+	}
+	f.chats[chat.ChatID] = stored
+	return stored
+}
+
+// Copy of a stored chat, messages included
+func (f *fakeStore) chat(chatID string) (Chat, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stored, ok := f.chats[chatID]
+	if !ok {
+		return Chat{}, false
+	}
+	chat := stored.Chat
+	chat.Messages = cloneMessages(stored.Messages)
+	return chat, true
+}
+
+// Move the chat's n oldest live messages to the archive
+func (f *fakeStore) archive(chatID string, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.chats[chatID].archiveOldest(n)
+}
+
+func (f *fakeStore) fail(err error) {
+	f.mu.Lock()
+	f.err = err
+	f.mu.Unlock()
+}
+
+func cloneMessage(msg ChatMessage) ChatMessage {
+	msg.ReadBy = append([]string(nil), msg.ReadBy...)
+	msg.Attachments = append([]Attachment(nil), msg.Attachments...)
+	msg.EditHistory = append([]EditRecord(nil), msg.EditHistory...)
+	if msg.Reactions != nil {
+		reactions := make(map[string][]string, len(msg.Reactions))
+		for emoji, users := range msg.Reactions {
+			reactions[emoji] = append([]string(nil), users...)
+		}
+		msg.Reactions = reactions
+	}
+	return msg
+}
+
+func cloneMessages(messages []ChatMessage) []ChatMessage {
+	if messages == nil {
+		return nil
+	}
+	clones := make([]ChatMessage, len(messages))
+	for i, msg := range messages {
+		clones[i] = cloneMessage(msg)
+	}
+	return clones
+}
+
+// The chat without its messages, as listings return it
+func (c *fakeChat) summary() Chat {
+	chat := c.Chat
+	chat.Messages = nil
+	chat.LastMessage = cloneMessage(chat.LastMessage)
+	chat.Tags = append([]string(nil), chat.Tags...)
+	return chat
+}
+
+func (c *fakeChat) message(msgID string) *ChatMessage {
+	for i := range c.Messages {
+		if c.Messages[i].MsgID == msgID {
+			return &c.Messages[i]
+		}
+	}
+	return nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeStore) GetChat(ctx context.Context, chatID string) (Chat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return Chat{}, f.err
+	}
+	stored, ok := f.chats[chatID]
+	if !ok {
+		return Chat{}, mongo.ErrNoDocuments
+	}
+	return stored.summary(), nil
+}
+
+func (f *fakeStore) FindByUser(ctx context.Context, userEmail, status string) ([]Chat, error) {
+	chats, _, err := f.ListChats(ctx, ChatListQuery{UserEmail: userEmail, Status: status})
+	return chats, err
+}
+
+func (f *fakeStore) FindActive(ctx context.Context, query ActiveChatsQuery) ([]ChatSummary, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, 0, f.err
+	}
+
+	var chats []ChatSummary
+	for _, stored := range f.chats {
+		if stored.Status != "active" || (query.Tag != "" && !hasTag(stored.Tags, query.Tag)) {
+			continue
+		}
+		summary := ChatSummary{Chat: stored.summary()}
+		for _, msg := range stored.Messages {
+			if msg.SenderRole == roleCustomer {
+				read := false
+				for _, reader := range msg.ReadBy {
+					read = read || reader != stored.UserEmail
+				}
+				if !read {
+					summary.UnreadCount++
+				}
+				if summary.WaitingSince == nil {
+					ts := msg.Timestamp
+					summary.WaitingSince = &ts
+				}
+			} else if msg.SenderRole == roleAdmin || msg.SenderRole == roleBot {
+				summary.WaitingSince = nil
+			}
+		}
+		chats = append(chats, summary)
+	}
+
+	sort.Slice(chats, func(i, j int) bool {
+		a, b := chats[i], chats[j]
+		if query.SortByWaiting && (a.WaitingSince == nil) != (b.WaitingSince == nil) {
+			return a.WaitingSince != nil
+		}
+		if query.SortByWaiting && a.WaitingSince != nil && !a.WaitingSince.Equal(*b.WaitingSince) {
+			return a.WaitingSince.Before(*b.WaitingSince)
+		}
+		if !a.LastMessageTime.Equal(b.LastMessageTime) {
+			return a.LastMessageTime.After(b.LastMessageTime)
+		}
+		return a.ChatID > b.ChatID
+	})
+	total := int64(len(chats))
+	return page(chats, query.Skip, query.Limit), total, nil
+}
+
+// The skip/limit window of a sorted slice; a limit of 0 means no limit
+func page[T any](items []T, skip, limit int) []T {
+	if skip >= len(items) {
+		return nil
+	}
+	items = items[skip:]
+	if limit > 0 && limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
+
+func (f *fakeStore) ListChats(ctx context.Context, query ChatListQuery) ([]Chat, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, 0, f.err
+	}
+
+	chats := []Chat{}
+	for _, stored := range f.chats {
+		switch {
+		case query.Status != "" && stored.Status != query.Status,
+			query.UserEmail != "" && stored.UserEmail != query.UserEmail,
+			query.AssignedTo != "" && stored.AssignedTo != query.AssignedTo,
+			query.Tag != "" && !hasTag(stored.Tags, query.Tag),
+			query.From != nil && stored.LastMessageTime.Before(*query.From),
+			query.To != nil && stored.LastMessageTime.After(*query.To):
+			continue
+		}
+		chats = append(chats, stored.summary())
+	}
+
+	sort.Slice(chats, func(i, j int) bool {
+		a, b := chats[i], chats[j]
+		if query.ByClosedAt && !a.ClosedAt.Equal(b.ClosedAt) {
+			return a.ClosedAt.After(b.ClosedAt)
+		}
+		if !a.LastMessageTime.Equal(b.LastMessageTime) {
+			return a.LastMessageTime.After(b.LastMessageTime)
+		}
+		return a.ChatID > b.ChatID
+	})
+	total := int64(len(chats))
+	if paged := page(chats, query.Skip, query.Limit); paged != nil {
+		chats = paged
+	} else {
+		chats = []Chat{}
+	}
+	return chats, total, nil
+}
+
+func (f *fakeStore) ActiveChatID(ctx context.Context, userEmail string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return "", f.err
+	}
+	return f.activeChatIDLocked(userEmail, ""), nil
+}
+
+// ID of the user's active chat other than except, "" when there is none
+func (f *fakeStore) activeChatIDLocked(userEmail, except string) string {
+	for chatID, stored := range f.chats {
+		if stored.UserEmail == userEmail && stored.Status == "active" && chatID != except {
+			return chatID
+		}
+	}
+	return ""
+}
+
+func (f *fakeStore) FindChatIDs(ctx context.Context, query ChatIDQuery) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	var chatIDs []string
+	for chatID, stored := range f.chats {
+		lastActive := stored.LastMessageTime
+		if lastActive.IsZero() {
+			lastActive = stored.CreatedAt
+		}
+		closed := stored.ClosedAt
+		if closed.IsZero() {
+			closed = stored.LastMessageTime
+		}
+		switch {
+		case query.UserEmail != "" && stored.UserEmail != query.UserEmail,
+			query.Status != "" && stored.Status != query.Status,
+			query.CreatedBefore != nil && !stored.CreatedAt.Before(*query.CreatedBefore),
+			query.IdleBefore != nil && !lastActive.Before(*query.IdleBefore),
+			query.ClosedBefore != nil && !closed.Before(*query.ClosedBefore):
+			continue
+		}
+		chatIDs = append(chatIDs, chatID)
+	}
+	sort.Strings(chatIDs)
+	return chatIDs, nil
+}
+
+func (f *fakeStore) CreateChat(ctx context.Context, chat Chat) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return false, f.err
+	}
+	if _, ok := f.chats[chat.ChatID]; ok {
+		return false, nil
+	}
+	if f.activeChatIDLocked(chat.UserEmail, "") != "" {
+		return false, errActiveChatExists
+	}
+	chat.Status = "active"
+	chat.Messages = nil
+	chat.LastMessageTime = chat.CreatedAt
+	f.chats[chat.ChatID] = &fakeChat{Chat: chat}
+	return true, nil
+}
+
+func (f *fakeStore) SetStatus(ctx context.Context, chatID, status, changedBy string, at time.Time) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return false, f.err
+	}
+	stored, ok := f.chats[chatID]
+	if !ok {
+		return false, nil
+	}
+	stored.Status = status
+	if status == "ended" {
+		stored.ClosedAt = at
+		stored.ClosedBy = changedBy
+	}
+	return true, nil
+}
+
+func (f *fakeStore) ReopenChat(ctx context.Context, chatID, reopenedBy string, at time.Time) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return false, f.err
+	}
+	stored, ok := f.chats[chatID]
+	if !ok || stored.Status != "ended" {
+		return false, nil
+	}
+	if f.activeChatIDLocked(stored.UserEmail, chatID) != "" {
+		return false, errActiveChatExists
+	}
+	stored.Status = "active"
+	stored.ReopenedBy = reopenedBy
+	stored.ReopenedAt = at
+	stored.ClosedAt = time.Time{}
+	stored.ClosedBy = ""
+	return true, nil
+}
+
+func (f *fakeStore) DeleteChats(ctx context.Context, chatIDs []string, status string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return 0, f.err
+	}
+	var deleted int64
+	for _, chatID := range chatIDs {
+		if stored, ok := f.chats[chatID]; ok && (status == "" || stored.Status == status) {
+			delete(f.chats, chatID)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (f *fakeStore) AssignChat(ctx context.Context, chatID, to string, from []string, at time.Time) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return false, f.err
+	}
+	stored, ok := f.chats[chatID]
+	if !ok || stored.Status != "active" {
+		return false, nil
+	}
+	if from != nil && !hasTag(from, stored.AssignedTo) {
+		return false, nil
+	}
+	stored.AssignedTo = to
+	stored.AssignedAt = at
+	return true, nil
+}
+
+func (f *fakeStore) UpdateTags(ctx context.Context, chatID string, add, remove []string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	stored, ok := f.chats[chatID]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	for _, tag := range add {
+		if !hasTag(stored.Tags, tag) {
+			stored.Tags = append(stored.Tags, tag)
+		}
+	}
+	var kept []string
+	for _, tag := range stored.Tags {
+		if !hasTag(remove, tag) {
+			kept = append(kept, tag)
+		}
+	}
+	stored.Tags = kept
+	return append([]string(nil), kept...), nil
+}
+
+func (f *fakeStore) UpdateMetadata(ctx context.Context, chatID string, rev int64, set map[string]interface{}, unset []string) (map[string]interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	stored, ok := f.chats[chatID]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	if stored.MetadataRev != rev {
+		return nil, errMetadataConflict
+	}
+	stored.MetadataRev++
+	if stored.Metadata == nil {
+		stored.Metadata = map[string]interface{}{}
+	}
+	for key, value := range set {
+		stored.Metadata[key] = value
+	}
+	for _, key := range unset {
+		delete(stored.Metadata, key)
+	}
+	metadata := make(map[string]interface{}, len(stored.Metadata))
+	for key, value := range stored.Metadata {
+		metadata[key] = value
+	}
+	return metadata, nil
+}
+
+func (f *fakeStore) ReassignGuestChats(ctx context.Context, guestID, userEmail string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return 0, f.err
+	}
+	if f.activeChatIDLocked(guestID, "") != "" && f.activeChatIDLocked(userEmail, "") != "" {
+		return 0, errActiveChatExists
+	}
+	var moved int64
+	for _, stored := range f.chats {
+		if stored.UserEmail != guestID {
+			continue
+		}
+		stored.UserEmail = userEmail
+		stored.GuestID = guestID
+		for i := range stored.Messages {
+			if stored.Messages[i].Sender == guestID {
+				stored.Messages[i].Sender = userEmail
+			}
+		}
+		if stored.LastMessage.Sender == guestID {
+			stored.LastMessage.Sender = userEmail
+		}
+		for i := range stored.Archived {
+			if stored.Archived[i].Sender == guestID {
+				stored.Archived[i].Sender = userEmail
+			}
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// Chats score one point per message containing any of the query's words
+func (f *fakeStore) SearchChats(ctx context.Context, query SearchQuery) ([]SearchHit, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, 0, f.err
+	}
+
+	words := strings.Fields(strings.ToLower(query.Text))
+	var hits []SearchHit
+	for _, stored := range f.chats {
+		if query.UserEmail != "" && stored.UserEmail != query.UserEmail {
+			continue
+		}
+		score := 0.0
+		for _, msg := range stored.Messages {
+			text := strings.ToLower(msg.Message)
+			for _, word := range words {
+				if strings.Contains(text, word) {
+					score++
+					break
+				}
+			}
+		}
+		if score > 0 {
+			chat := stored.summary()
+			chat.Messages = cloneMessages(stored.Messages)
+			hits = append(hits, SearchHit{Chat: chat, Score: score})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ChatID < hits[j].ChatID
+	})
+	total := int64(len(hits))
+	return page(hits, query.Skip, query.Limit), total, nil
+}
+
+func (f *fakeStore) Stats(ctx context.Context, from, to *time.Time) (ChatStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var stats ChatStats
+	if f.err != nil {
+		return stats, f.err
+	}
+
+	chats, durations := 0, 0
+	var totalDuration float64
+	for _, stored := range f.chats {
+		if (from != nil && stored.CreatedAt.Before(*from)) || (to != nil && stored.CreatedAt.After(*to)) {
+			continue
+		}
+		chats++
+		stats.TotalMessages += len(stored.Messages)
+		switch stored.Status {
+		case "active":
+			stats.ActiveChats++
+		case "ended":
+			stats.EndedChats++
+			if !stored.CreatedAt.IsZero() && !stored.ClosedAt.IsZero() {
+				durations++
+				totalDuration += stored.ClosedAt.Sub(stored.CreatedAt).Seconds()
+			}
+		}
+	}
+	if chats > 0 {
+		stats.AvgMessagesPerChat = float64(stats.TotalMessages) / float64(chats)
+	}
+	if durations > 0 {
+		stats.AvgChatDurationSeconds = totalDuration / float64(durations)
+	}
+	return stats, nil
+}
+
+func (f *fakeStore) CountByStatus(ctx context.Context, userEmail string) (map[string]int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	counts := map[string]int64{}
+	for _, stored := range f.chats {
+		if stored.UserEmail == userEmail {
+			counts[stored.Status]++
+		}
+	}
+	return counts, nil
+}
+
+func (f *fakeStore) AppendMessage(ctx context.Context, chatID string, msg ChatMessage) (int64, int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return 0, 0, f.err
+	}
+	if f.appendErr != nil {
+		return 0, 0, f.appendErr
+	}
+	stored, ok := f.chats[chatID]
+	if !ok || stored.Status != "active" {
+		return 0, 0, errChatClosed
+	}
+	if msg.ClientMsgID != "" {
+		for _, existing := range stored.Messages {
+			if existing.ClientMsgID == msg.ClientMsgID {
+				return 0, 0, errChatClosed
+			}
+		}
+	}
+	stored.Seq++
+	msg.Seq = stored.Seq
+	stored.Messages = append(stored.Messages, cloneMessage(msg))
+	stored.LastMessage = cloneMessage(msg)
+	stored.LastMessageTime = msg.Timestamp
+	return stored.Seq, len(stored.Messages), nil
+}
+
+func (f *fakeStore) HistoryPage(ctx context.Context, chatID string, query HistoryQuery) (HistoryPage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return HistoryPage{}, f.err
+	}
+	stored, ok := f.chats[chatID]
+	if !ok {
+		return HistoryPage{}, mongo.ErrNoDocuments
+	}
+
+	messages := stored.Messages
+	if query.BeforeIndex != nil {
+		messages = messages[:min(max(*query.BeforeIndex-stored.ArchivedCount, 0), len(messages))]
+	}
+	var matching []ChatMessage
+	for _, msg := range messages {
+		switch {
+		case query.BeforeIndex == nil && query.BeforeTime != nil && !msg.Timestamp.Before(*query.BeforeTime),
+			query.Sender != "" && msg.Sender != query.Sender,
+			query.Role != "" && msg.SenderRole != query.Role:
+			continue
+		}
+		matching = append(matching, msg)
+	}
+
+	result := HistoryPage{Total: len(matching), ArchivedCount: stored.ArchivedCount}
+	result.Messages = cloneMessages(matching[max(len(matching)-query.Limit, 0):])
+	return result, nil
+}
+
+func (f *fakeStore) ArchivedHistory(ctx context.Context, chatID string, query HistoryQuery) ([]ArchivedMessage, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, false, f.err
+	}
+	stored, ok := f.chats[chatID]
+	if !ok {
+		return nil, false, nil
+	}
+
+	var matching []ArchivedMessage
+	for _, archived := range stored.Archived {
+		switch {
+		case query.BeforeIndex != nil && archived.Index >= *query.BeforeIndex,
+			query.BeforeIndex == nil && query.BeforeTime != nil && !archived.Timestamp.Before(*query.BeforeTime),
+			query.Sender != "" && archived.Sender != query.Sender,
+			query.Role != "" && archived.SenderRole != query.Role:
+			continue
+		}
+		matching = append(matching, archived)
+	}
+	hasMore := len(matching) > query.Limit
+	return append([]ArchivedMessage(nil), matching[max(len(matching)-query.Limit, 0):]...), hasMore, nil
+}
+
+func (f *fakeStore) ArchiveOverflow(ctx context.Context, chatID string, count int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	if stored, ok := f.chats[chatID]; ok {
+		stored.archiveOldest(count - maxInlineMessages*9/10)
+	}
+	return nil
+}
+
+// Move the n oldest live messages to the archive
+func (c *fakeChat) archiveOldest(n int) {
+	n = min(n, len(c.Messages))
+	if n <= 0 {
+		return
+	}
+	for i, msg := range c.Messages[:n] {
+		c.Archived = append(c.Archived, ArchivedMessage{ChatID: c.ChatID, Index: c.ArchivedCount + i, ChatMessage: msg})
+	}
+	c.Messages = append([]ChatMessage(nil), c.Messages[n:]...)
+	c.ArchivedCount += n
+}
+
+func (f *fakeStore) MessagesSince(ctx context.Context, chatID, lastMessageID string, since time.Time, limit int) ([]ChatMessage, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, false, f.err
+	}
+	stored, ok := f.chats[chatID]
+	if !ok {
+		return nil, false, mongo.ErrNoDocuments
+	}
+
+	// The whole history, archived messages first
+	all := make([]ChatMessage, 0, len(stored.Archived)+len(stored.Messages))
+	for _, archived := range stored.Archived {
+		all = append(all, archived.ChatMessage)
+	}
+	all = append(all, stored.Messages...)
+
+	var newer []ChatMessage
+	if lastMessageID != "" {
+		for i, msg := range all {
+			if msg.MsgID == lastMessageID {
+				newer = all[i+1:]
+				break
+			}
+		}
+	} else {
+		for _, msg := range all {
+			if msg.Timestamp.After(since) {
+				newer = append(newer, msg)
+			}
+		}
+	}
+	if len(newer) > limit {
+		return cloneMessages(newer[:limit]), true, nil
+	}
+	return cloneMessages(newer), false, nil
+}
+
+func (f *fakeStore) ExportMessages(ctx context.Context, chatID string, fn func(ChatMessage) error) error {
+	f.mu.Lock()
+	if f.err != nil {
+		f.mu.Unlock()
+		return f.err
+	}
+	var messages []ChatMessage
+	if stored, ok := f.chats[chatID]; ok {
+		for _, archived := range stored.Archived {
+			messages = append(messages, archived.ChatMessage)
+		}
+		messages = append(messages, cloneMessages(stored.Messages)...)
+	}
+	f.mu.Unlock()
+
+	for _, msg := range messages {
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeStore) FindMessage(ctx context.Context, chatID, msgID string) (ChatMessage, error) {
+	return f.findMessageBy(chatID, func(msg ChatMessage) bool { return msg.MsgID == msgID })
+}
+
+func (f *fakeStore) FindMessageByClientID(ctx context.Context, chatID, clientMsgID string) (ChatMessage, error) {
+	return f.findMessageBy(chatID, func(msg ChatMessage) bool { return msg.ClientMsgID == clientMsgID })
+}
+
+func (f *fakeStore) findMessageBy(chatID string, match func(ChatMessage) bool) (ChatMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return ChatMessage{}, f.err
+	}
+	if stored, ok := f.chats[chatID]; ok {
+		for _, msg := range stored.Messages {
+			if match(msg) {
+				return cloneMessage(msg), nil
+			}
+		}
+		for _, archived := range stored.Archived {
+			if match(archived.ChatMessage) {
+				return cloneMessage(archived.ChatMessage), errMessageArchived
+			}
+		}
+	}
+	return ChatMessage{}, errMessageNotFound
+}
+
+// Run change on a live message, doing nothing when there is no such message
+func (f *fakeStore) updateMessage(chatID, msgID string, change func(*ChatMessage)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	if stored, ok := f.chats[chatID]; ok {
+		if msg := stored.message(msgID); msg != nil {
+			change(msg)
+		}
+	}
+	return nil
+}
+
+func (f *fakeStore) EditMessage(ctx context.Context, chatID, msgID, sender, text string, at time.Time, previous *EditRecord) error {
+	return f.updateMessage(chatID, msgID, func(msg *ChatMessage) {
+		if msg.Sender != sender {
+			return
+		}
+		msg.Message = text
+		msg.EditedAt = &at
+		if previous != nil {
+			msg.EditHistory = append(msg.EditHistory, *previous)
+		}
+		if last := &f.chats[chatID].LastMessage; last.MsgID == msgID {
+			*last = cloneMessage(*msg)
+		}
+	})
+}
+
+func (f *fakeStore) DeleteMessage(ctx context.Context, chatID, msgID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	stored, ok := f.chats[chatID]
+	if !ok || stored.message(msgID) == nil {
+		return nil
+	}
+	deleted := func(msg *ChatMessage) {
+		switch {
+		case msg.MsgID == msgID:
+			msg.Deleted = true
+			msg.Message = ""
+			msg.Pinned = false
+		case msg.ReplyPreview != nil && msg.ReplyPreview.MsgID == msgID:
+			preview := *msg.ReplyPreview
+			preview.Snippet = ""
+			msg.ReplyPreview = &preview
+		}
+	}
+	for i := range stored.Messages {
+		deleted(&stored.Messages[i])
+	}
+	deleted(&stored.LastMessage)
+	return nil
+}
+
+func (f *fakeStore) SetPinned(ctx context.Context, chatID, msgID string, pinned bool) error {
+	return f.updateMessage(chatID, msgID, func(msg *ChatMessage) {
+		msg.Pinned = pinned
+	})
+}
+
+func (f *fakeStore) PinnedMessages(ctx context.Context, chatID string) ([]ChatMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	stored, ok := f.chats[chatID]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	var pinned []ChatMessage
+	for _, msg := range stored.Messages {
+		if msg.Pinned {
+			pinned = append(pinned, cloneMessage(msg))
+		}
+	}
+	return pinned, nil
+}
+
+func (f *fakeStore) ToggleReaction(ctx context.Context, chatID, msgID, userEmail, emoji string) error {
+	found := false
+	err := f.updateMessage(chatID, msgID, func(msg *ChatMessage) {
+		if msg.Deleted {
+			return
+		}
+		found = true
+		users := msg.Reactions[emoji]
+		for i, user := range users {
+			if user == userEmail {
+				users = append(users[:i:i], users[i+1:]...)
+				if len(users) == 0 {
+					delete(msg.Reactions, emoji)
+				} else {
+					msg.Reactions[emoji] = users
+				}
+				return
+			}
+		}
+		if msg.Reactions == nil {
+			msg.Reactions = map[string][]string{}
+		}
+		msg.Reactions[emoji] = append(users, userEmail)
+	})
+	if err == nil && !found {
+		err = errMessageNotFound
+	}
+	return err
+}
+
+func (f *fakeStore) AddAttachment(ctx context.Context, chatID, msgID, sender string, attachment Attachment) (bool, error) {
+	added := false
+	err := f.updateMessage(chatID, msgID, func(msg *ChatMessage) {
+		if msg.Sender == sender && len(msg.Attachments) < maxAttachmentsPerMessage {
+			msg.Attachments = append(msg.Attachments, attachment)
+			added = true
+		}
+	})
+	return added, err
+}
+
+func (f *fakeStore) MarkRead(ctx context.Context, chatID string, msgIDs []string, reader string) error {
+	for _, msgID := range msgIDs {
+		err := f.updateMessage(chatID, msgID, func(msg *ChatMessage) {
+			if !hasTag(msg.ReadBy, reader) {
+				msg.ReadBy = append(msg.ReadBy, reader)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeStore) MarkAllRead(ctx context.Context, chatID, reader, owner string) (bool, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return false, false, f.err
+	}
+	stored, ok := f.chats[chatID]
+	if !ok || (owner != "" && stored.UserEmail != owner) {
+		return false, false, nil
+	}
+	changed := false
+	for i := range stored.Messages {
+		if !hasTag(stored.Messages[i].ReadBy, reader) {
+			stored.Messages[i].ReadBy = append(stored.Messages[i].ReadBy, reader)
+			changed = true
+		}
+	}
+	return true, changed, nil
+}
+
+func (f *fakeStore) FindBan(ctx context.Context, userEmail string) (*Ban, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	if ban, ok := f.bans[userEmail]; ok {
+		return &ban, nil
+	}
+	return nil, nil
+}
+
+func (f *fakeStore) SaveBan(ctx context.Context, ban Ban) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.bans[ban.UserEmail] = ban
+	return nil
+}
+
+func (f *fakeStore) DeleteBan(ctx context.Context, userEmail string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return false, f.err
+	}
+	_, ok := f.bans[userEmail]
+	delete(f.bans, userEmail)
+	return ok, nil
+}
+
+func (f *fakeStore) AddScheduled(ctx context.Context, scheduled ScheduledMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.scheduled[scheduled.ID] = scheduled
+	return nil
+}
+
+func (f *fakeStore) PendingScheduled(ctx context.Context, chatID string) ([]ScheduledMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	pending := []ScheduledMessage{}
+	for _, scheduled := range f.scheduled {
+		if scheduled.ChatID == chatID && scheduled.Status == scheduledPending {
+			pending = append(pending, scheduled)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].SendAt.Before(pending[j].SendAt) })
+	return pending, nil
+}
+
+func (f *fakeStore) CancelScheduled(ctx context.Context, chatID, scheduleID string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return false, f.err
+	}
+	scheduled, ok := f.scheduled[scheduleID]
+	if !ok || scheduled.ChatID != chatID || scheduled.Status != scheduledPending {
+		return false, nil
+	}
+	scheduled.Status = scheduledCanceled
+	f.scheduled[scheduleID] = scheduled
+	return true, nil
+}
+
+func (f *fakeStore) ClaimDueScheduled(ctx context.Context, now time.Time) (ScheduledMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return ScheduledMessage{}, f.err
+	}
+	var due *ScheduledMessage
+	for _, scheduled := range f.scheduled {
+		pending := scheduled.Status == scheduledPending && !scheduled.SendAt.After(now) &&
+			(scheduled.NextAttemptAt == nil || !scheduled.NextAttemptAt.After(now))
+		stalled := scheduled.Status == scheduledSending && scheduled.ClaimedAt != nil &&
+			scheduled.ClaimedAt.Before(now.Add(-scheduleClaimLease))
+		if (pending || stalled) && (due == nil || scheduled.SendAt.Before(due.SendAt)) {
+			candidate := scheduled
+			due = &candidate
+		}
+	}
+	if due == nil {
+		return ScheduledMessage{}, mongo.ErrNoDocuments
+	}
+	due.Status = scheduledSending
+	due.ClaimedAt = &now
+	due.Attempts++
+	f.scheduled[due.ID] = *due
+	return *due, nil
+}
+
+func (f *fakeStore) UpdateScheduled(ctx context.Context, scheduled ScheduledMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	stored, ok := f.scheduled[scheduled.ID]
+	if !ok {
+		return nil
+	}
+	stored.Status = scheduled.Status
+	if scheduled.SentAt != nil {
+		stored.SentAt = scheduled.SentAt
+	}
+	if scheduled.MsgID != "" {
+		stored.MsgID = scheduled.MsgID
+	}
+	if scheduled.NextAttemptAt != nil {
+		stored.NextAttemptAt = scheduled.NextAttemptAt
+	}
+	if scheduled.LastError != "" {
+		stored.LastError = scheduled.LastError
+	}
+	f.scheduled[scheduled.ID] = stored
+	return nil
+}
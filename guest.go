@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// With GUEST_CHATS_ENABLED a WebSocket connecting without a token gets a
+// generated guest identity. The guest token in the init event lets it
+// reconnect to its chat until GUEST_TOKEN_TTL runs out.
+var (
+	guestChatsEnabled = getEnv("GUEST_CHATS_ENABLED", "false") == "true"
+	guestTokenTTL     = getEnvDuration("GUEST_TOKEN_TTL", 30*24*time.Hour)
+)
+
+const guestIDPrefix = "guest-"
+
+var errNotGuestToken = errors.New("not a guest token")
+
+// Mint a guest identity and the token that proves it
+func newGuest() (*Claims, string, error) {
+	claims := &Claims{
+		Email:     guestIDPrefix + uuid.New().String(),
+		Role:      roleGuest,
+		ExpiresAt: time.Now().Add(guestTokenTTL).Unix(),
+	}
+	token, err := signToken(claims, jwtSecret)
+	if err != nil {
+		return nil, "", err
+	}
+	return claims, token, nil
+}
+
+// Move a guest's chats to the authenticated user once the guest logs in.
+// The body carries the guest token, so only whoever holds it can claim the history.
+func mergeGuestChats(store ChatStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := authenticate(c.Request)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+		if claims.IsGuest() {
+			respondError(c, http.StatusForbidden, codeForbidden, "Guests can't claim chats")
+			return
+		}
+
+		var body struct {
+			GuestToken string `json:"guestToken"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || body.GuestToken == "" {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "guestToken is required")
+			return
+		}
+		guest, err := parseToken(body.GuestToken, jwtSecret)
+		if err == nil && (!guest.IsGuest() || !strings.HasPrefix(guest.Email, guestIDPrefix)) {
+			err = errNotGuestToken
+		}
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "Invalid guest token: "+err.Error())
+			return
+		}
+
+		ctx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+
+		merged, err := store.ReassignGuestChats(ctx, guest.Email, claims.Email)
+		if errors.Is(err, errActiveChatExists) {
+			respondError(c, http.StatusConflict, codeActiveChatExists, "Both the guest and the user have an active chat")
+			return
+		}
+		if err != nil {
+			slog.Error("Error merging guest chats", "event", "guest_merge", "guestId", guest.Email, "userEmail", claims.Email, "error", err)
+			respondDBError(c, err, "Could not merge guest chats")
+			return
+		}
+
+		slog.Info("Guest chats merged", "event", "guest_merge", "guestId", guest.Email, "userEmail", claims.Email, "chats", merged)
+		respond(c, http.StatusOK, gin.H{"guestId": guest.Email, "userEmail": claims.Email, "merged": merged})
+	}
+}
+
+// Hand the guest's chats and the messages it sent over to userEmail.
+// guestId stays on the chats to record where they came from.
+func (s *mongoStore) ReassignGuestChats(ctx context.Context, guestID, userEmail string) (int64, error) {
+	chatIDs, err := s.chats.Distinct(ctx, "chatId", bson.M{"userEmail": guestID})
+	if err != nil || len(chatIDs) == 0 {
+		return 0, err
+	}
+	inChats := bson.M{"$in": chatIDs}
+
+	update := bson.M{"$set": bson.M{
+		"userEmail":            userEmail,
+		"guestId":              guestID,
+		"messages.$[m].sender": userEmail,
+	}}
+	opts := options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: []interface{}{bson.M{"m.sender": guestID}},
+	})
+	result, err := s.chats.UpdateMany(ctx, bson.M{"chatId": inChats, "userEmail": guestID}, update, opts)
+	if mongo.IsDuplicateKeyError(err) {
+		return 0, errActiveChatExists
+	}
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.chats.UpdateMany(ctx,
+		bson.M{"chatId": inChats, "lastMessage.sender": guestID},
+		bson.M{"$set": bson.M{"lastMessage.sender": userEmail}},
+	); err != nil {
+		return result.ModifiedCount, err
+	}
+	if _, err := s.archive.UpdateMany(ctx,
+		bson.M{"chatId": inChats, "sender": guestID},
+		bson.M{"$set": bson.M{"sender": userEmail}},
+	); err != nil {
+		return result.ModifiedCount, err
+	}
+	return result.ModifiedCount, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How long the readiness probe waits for MongoDB
+const readinessTimeout = 2 * time.Second
+
+// Liveness probe: the process is up and serving
+func healthz(c *gin.Context) {
+	respond(c, http.StatusOK, gin.H{"status": "ok", "connections": registry.Count(), "build": currentBuild})
+}
+
+// Readiness probe: MongoDB answers a ping within readinessTimeout
+func readyz(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+	defer cancel()
+
+	if err := mongoClient.Ping(ctx, nil); err != nil {
+		slog.Warn("Readiness check failed", "event", "readyz", "error", err)
+		respondError(c, http.StatusServiceUnavailable, codeUnavailable, "Database is unreachable")
+		return
+	}
+	respond(c, http.StatusOK, gin.H{"status": "ok", "connections": registry.Count(), "build": currentBuild})
+}
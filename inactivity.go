@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// Active chats without a new message for CHAT_INACTIVITY_TIMEOUT are closed,
+// checked every INACTIVITY_SWEEP_INTERVAL. A timeout of 0 (the default)
+// leaves idle chats open.
+var (
+	chatInactivityTimeout   = getEnvDuration("CHAT_INACTIVITY_TIMEOUT", 0)
+	inactivitySweepInterval = getEnvDuration("INACTIVITY_SWEEP_INTERVAL", time.Minute)
+)
+
+// Periodically close idle chats until ctx is cancelled
+func runInactivitySweeper(ctx context.Context, store ChatStore) {
+	if chatInactivityTimeout <= 0 {
+		slog.Info("Inactivity auto-close disabled", "event", "inactivity_close")
+		return
+	}
+	slog.Info("Inactivity auto-close enabled", "event", "inactivity_close", "timeout", chatInactivityTimeout.String(), "interval", inactivitySweepInterval.String())
+
+	runSweeper(ctx, inactivitySweepInterval, func(ctx context.Context) {
+		closeIdleChats(ctx, store)
+	})
+}
+
+// Close every active chat idle since before the cutoff. saveMessage stamps
+// lastMessageTime, so each message restarts the clock; chats that never got
+// a message fall back to createdAt.
+func closeIdleChats(parent context.Context, store ChatStore) {
+	cutoff := time.Now().Add(-chatInactivityTimeout)
+
+	ctx, cancel := dbContext(parent)
+	chatIDs, err := store.FindChatIDs(ctx, ChatIDQuery{Status: "active", IdleBefore: &cutoff})
+	cancel()
+	if err != nil {
+		slog.Error("Error finding idle chats", "event", "inactivity_close", "error", err)
+		return
+	}
+
+	closed := 0
+	for _, chatID := range chatIDs {
+		if closeChatWithNotice(parent, store, chatID, "This chat was closed due to inactivity.", "inactivity_close") {
+			closed++
+		}
+	}
+	if closed > 0 {
+		slog.Info("Closed idle chats", "event", "inactivity_close", "closed", closed, "cutoff", cutoff)
+	}
+}
+
+// Store a system notice and end the chat. The notice only saves while the
+// chat is still active, so a chat closed meanwhile is left alone.
+func closeChatWithNotice(parent context.Context, store ChatStore, chatID, text, event string) bool {
+	ctx, cancel := dbContext(parent)
+	defer cancel()
+
+	notice, err := saveMessage(ctx, store, chatID, ChatMessage{
+		Sender:     "System",
+		SenderName: "System",
+		SenderRole: roleSystem,
+		Message:    text,
+		Timestamp:  time.Now().UTC(),
+	})
+	if errors.Is(err, errChatClosed) {
+		return false
+	}
+	if err != nil {
+		slog.Error("Error saving close notice", "event", event, "chatId", chatID, "error", err)
+		return false
+	}
+
+	if _, err := endChat(ctx, store, chatID, roleSystem, &notice); err != nil {
+		slog.Error("Error closing chat", "event", event, "chatId", chatID, "error", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestLastMessageRoundTrip(t *testing.T) {
+	store := newFakeStore()
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	store.addChat(Chat{ChatID: "c1", UserEmail: "user@example.com", CreatedAt: base})
+	store.addChat(Chat{ChatID: "c2", UserEmail: "user@example.com", CreatedAt: base, Status: "ended"})
+
+	var last ChatMessage
+	for i := 0; i < 3; i++ {
+		saved, err := saveMessage(context.Background(), store, "c1", ChatMessage{
+			Sender:    "user@example.com",
+			Message:   fmt.Sprintf("message %d", i),
+			Timestamp: base.Add(time.Duration(i+1) * time.Minute),
+		})
+		if err != nil {
+			t.Fatalf("saveMessage %d: %v", i, err)
+		}
+		last = saved
+	}
+
+	chat, err := store.GetChat(context.Background(), "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chat.LastMessage.MsgID != last.MsgID || chat.LastMessage.Message != "message 2" {
+		t.Errorf("lastMessage = %+v, want %+v", chat.LastMessage, last)
+	}
+	if !chat.LastMessageTime.Equal(last.Timestamp) {
+		t.Errorf("lastMessageTime = %v, want %v", chat.LastMessageTime, last.Timestamp)
+	}
+
+	// The fields decode back from the stored document under their bson names
+	data, err := bson.Marshal(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw bson.M
+	bson.Unmarshal(data, &raw)
+	if _, ok := raw["lastMessage"]; !ok {
+		t.Error("lastMessage is missing from the document")
+	}
+	if _, ok := raw["lastMessageTime"]; !ok {
+		t.Error("lastMessageTime is missing from the document")
+	}
+	var decoded Chat
+	if err := bson.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.LastMessage.MsgID != last.MsgID || decoded.LastMessage.Message != last.Message || !decoded.LastMessageTime.Equal(last.Timestamp) {
+		t.Errorf("decoded lastMessage %+v at %v, want %+v", decoded.LastMessage, decoded.LastMessageTime, last)
+	}
+
+	// Listings sort by the last message
+	chats, err := store.FindByUser(context.Background(), "user@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chats) != 2 || chats[0].ChatID != "c1" {
+		t.Errorf("chats by recency = %v, want c1 first", chats)
+	}
+}
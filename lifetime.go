@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Active chats older than CHAT_MAX_DURATION are closed whatever their
+// activity, checked every CHAT_DURATION_SWEEP_INTERVAL. A duration of 0
+// (the default) puts no limit on a chat's lifetime.
+var (
+	chatMaxDuration       = getEnvDuration("CHAT_MAX_DURATION", 0)
+	durationSweepInterval = getEnvDuration("CHAT_DURATION_SWEEP_INTERVAL", time.Minute)
+)
+
+// Periodically close chats past their maximum lifetime until ctx is cancelled
+func runDurationSweeper(ctx context.Context, store ChatStore) {
+	if chatMaxDuration <= 0 {
+		slog.Info("Maximum chat duration disabled", "event", "duration_close")
+		return
+	}
+	slog.Info("Maximum chat duration enabled", "event", "duration_close", "maxDuration", chatMaxDuration.String(), "interval", durationSweepInterval.String())
+
+	runSweeper(ctx, durationSweepInterval, func(ctx context.Context) {
+		closeExpiredChats(ctx, store)
+	})
+}
+
+// Close every active chat created before the cutoff
+func closeExpiredChats(parent context.Context, store ChatStore) {
+	cutoff := time.Now().Add(-chatMaxDuration)
+
+	ctx, cancel := dbContext(parent)
+	chatIDs, err := store.FindChatIDs(ctx, ChatIDQuery{Status: "active", CreatedBefore: &cutoff})
+	cancel()
+	if err != nil {
+		slog.Error("Error finding expired chats", "event", "duration_close", "error", err)
+		return
+	}
+
+	closed := 0
+	for _, chatID := range chatIDs {
+		if closeChatWithNotice(parent, store, chatID, "This chat was closed because it reached its maximum duration.", "duration_close") {
+			closed++
+		}
+	}
+	if closed > 0 {
+		slog.Info("Closed expired chats", "event", "duration_close", "closed", closed, "cutoff", cutoff)
+	}
+}
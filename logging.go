@@ -0,0 +1,18 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// Install a JSON logger as the default, at the level named by LOG_LEVEL
+// (debug, info, warn or error; info when unset)
+func setupLogger() {
+	var level slog.Level
+	levelErr := level.UnmarshalText([]byte(getEnv("LOG_LEVEL", "info")))
+
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
+	if levelErr != nil {
+		slog.Warn("Invalid LOG_LEVEL, using info", "event", "config", "error", levelErr)
+	}
+}
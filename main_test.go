@@ -0,0 +1,585 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	jwtSecret = []byte("test-secret")
+	os.Exit(m.Run())
+}
+
+// Signed bearer token for the claims, valid for an hour unless they expire sooner
+func testToken(t *testing.T, claims Claims) string {
+	t.Helper()
+	if claims.ExpiresAt == 0 {
+		claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+	}
+	token, err := signToken(&claims, jwtSecret)
+	if err != nil {
+		t.Fatalf("signToken: %v", err)
+	}
+	return token
+}
+
+// Serve one request through a router with the handler on route
+func serve(method, route, path string, body io.Reader, token string, handler gin.HandlerFunc) *httptest.ResponseRecorder {
+	router := gin.New()
+	router.Handle(method, route, handler)
+	req := httptest.NewRequest(method, path, body)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// Decode a response envelope, its data into data when it isn't nil
+func decodeEnvelope(t *testing.T, w *httptest.ResponseRecorder, data interface{}) *APIError {
+	t.Helper()
+	var env struct {
+		Data  json.RawMessage `json:"data"`
+		Error *APIError       `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	if data != nil && env.Error == nil {
+		if err := json.Unmarshal(env.Data, data); err != nil {
+			t.Fatalf("decoding data %s: %v", env.Data, err)
+		}
+	}
+	return env.Error
+}
+
+// A chat of n customer and admin messages, a minute apart from base
+func testChat(chatID string, n int, base time.Time) Chat {
+	chat := Chat{ChatID: chatID, UserEmail: "user@example.com", Status: "active", CreatedAt: base}
+	for i := 0; i < n; i++ {
+		sender, role := "user@example.com", roleCustomer
+		if i%2 == 1 {
+			sender, role = "agent@example.com", roleAdmin
+		}
+		chat.Messages = append(chat.Messages, ChatMessage{
+			MsgID:      fmt.Sprintf("m%d", i),
+			Sender:     sender,
+			SenderRole: role,
+			Message:    fmt.Sprintf("message %d", i),
+			Timestamp:  base.Add(time.Duration(i) * time.Minute),
+		})
+	}
+	return chat
+}
+
+func TestSaveMessage(t *testing.T) {
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		chat    *Chat
+		msg     ChatMessage
+		wantErr error
+		wantSeq int64
+	}{
+		{
+			name:    "appends to an active chat",
+			chat:    &Chat{ChatID: "c1", UserEmail: "user@example.com"},
+			msg:     ChatMessage{Sender: "user@example.com", SenderRole: roleCustomer, Message: "hello"},
+			wantSeq: 1,
+		},
+		{
+			name:    "missing chat",
+			msg:     ChatMessage{Sender: "user@example.com", Message: "hello"},
+			wantErr: errChatClosed,
+		},
+		{
+			name:    "ended chat",
+			chat:    &Chat{ChatID: "c1", UserEmail: "user@example.com", Status: "ended"},
+			msg:     ChatMessage{Sender: "user@example.com", Message: "hello"},
+			wantErr: errChatClosed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			if tt.chat != nil {
+				store.addChat(*tt.chat)
+			}
+			tt.msg.Timestamp = base
+
+			saved, err := saveMessage(context.Background(), store, "c1", tt.msg)
+			if err != tt.wantErr {
+				t.Fatalf("saveMessage error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if saved.MsgID == "" {
+				t.Error("saved message has no ID")
+			}
+			if saved.Seq != tt.wantSeq {
+				t.Errorf("seq = %d, want %d", saved.Seq, tt.wantSeq)
+			}
+			chat, _ := store.chat("c1")
+			if len(chat.Messages) != 1 || chat.Messages[0].MsgID != saved.MsgID {
+				t.Errorf("stored messages = %+v, want the saved message", chat.Messages)
+			}
+		})
+	}
+}
+
+func TestSaveMessageStoreError(t *testing.T) {
+	store := newFakeStore()
+	store.addChat(Chat{ChatID: "c1", UserEmail: "user@example.com"})
+	store.fail(errors.New("connection reset"))
+
+	if _, err := saveMessage(context.Background(), store, "c1", ChatMessage{Message: "hello"}); err == nil || err == errChatClosed {
+		t.Fatalf("saveMessage error = %v, want the store error", err)
+	}
+}
+
+func TestSaveMessageArchivesOverflow(t *testing.T) {
+	defer func(limit int) { maxInlineMessages = limit }(maxInlineMessages)
+	maxInlineMessages = 10
+
+	store := newFakeStore()
+	store.addChat(Chat{ChatID: "c1", UserEmail: "user@example.com"})
+	for i := 0; i < 11; i++ {
+		if _, err := saveMessage(context.Background(), store, "c1", ChatMessage{Message: strconv.Itoa(i)}); err != nil {
+			t.Fatalf("saveMessage %d: %v", i, err)
+		}
+	}
+
+	chat, _ := store.chat("c1")
+	if chat.ArchivedCount != 2 || len(chat.Messages) != 9 {
+		t.Fatalf("archived %d, inline %d; want 2 and 9", chat.ArchivedCount, len(chat.Messages))
+	}
+	if chat.Messages[0].Message != "2" {
+		t.Errorf("oldest inline message = %q, want %q", chat.Messages[0].Message, "2")
+	}
+}
+
+func TestCloseChat(t *testing.T) {
+	tests := []struct {
+		name       string
+		chat       *Chat
+		storeErr   error
+		body       string
+		token      *Claims
+		wantStatus int
+		wantCode   string
+		wantBy     string
+	}{
+		{
+			name:       "closed by the authenticated user",
+			chat:       &Chat{ChatID: "c1", UserEmail: "user@example.com"},
+			token:      &Claims{Email: "agent@example.com", Role: roleAdmin},
+			wantStatus: http.StatusOK,
+			wantBy:     "agent@example.com",
+		},
+		{
+			name:       "closedBy from the body without a token",
+			chat:       &Chat{ChatID: "c1", UserEmail: "user@example.com"},
+			body:       `{"closedBy":"ops@example.com"}`,
+			wantStatus: http.StatusOK,
+			wantBy:     "ops@example.com",
+		},
+		{
+			name:       "missing chat",
+			wantStatus: http.StatusNotFound,
+			wantCode:   codeChatNotFound,
+		},
+		{
+			name:       "store error",
+			chat:       &Chat{ChatID: "c1", UserEmail: "user@example.com"},
+			storeErr:   errors.New("connection reset"),
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   codeDatabaseError,
+		},
+		{
+			name:       "store timeout",
+			chat:       &Chat{ChatID: "c1", UserEmail: "user@example.com"},
+			storeErr:   context.DeadlineExceeded,
+			wantStatus: http.StatusGatewayTimeout,
+			wantCode:   codeDatabaseTimeout,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			if tt.chat != nil {
+				store.addChat(*tt.chat)
+			}
+			store.fail(tt.storeErr)
+			token := ""
+			if tt.token != nil {
+				token = testToken(t, *tt.token)
+			}
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+
+			w := serve(http.MethodPost, "/chats/:chatId/close", "/chats/c1/close", body, token, closeChat(store))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			apiErr := decodeEnvelope(t, w, nil)
+			if tt.wantCode != "" {
+				if apiErr == nil || apiErr.Code != tt.wantCode {
+					t.Fatalf("error = %+v, want code %s", apiErr, tt.wantCode)
+				}
+				return
+			}
+
+			store.fail(nil)
+			chat, _ := store.chat("c1")
+			if chat.Status != "ended" || chat.ClosedBy != tt.wantBy || chat.ClosedAt.IsZero() {
+				t.Errorf("chat status %q closedBy %q closedAt %v; want ended by %q", chat.Status, chat.ClosedBy, chat.ClosedAt, tt.wantBy)
+			}
+		})
+	}
+}
+
+type historyResponse struct {
+	Messages   []ChatMessage `json:"messages"`
+	HasMore    bool          `json:"hasMore"`
+	NextCursor string        `json:"nextCursor"`
+}
+
+// IDs of the messages, in order
+func messageIDs(messages []ChatMessage) string {
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.MsgID
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestGetChatHistory(t *testing.T) {
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minute int) string { return base.Add(time.Duration(minute) * time.Minute).Format(time.RFC3339) }
+
+	tests := []struct {
+		name       string
+		query      string
+		archive    int // Messages moved to the archive before the request
+		wantStatus int
+		wantIDs    string
+		wantMore   bool
+		wantCursor string
+	}{
+		{
+			name:       "limit returns the newest messages",
+			query:      "?limit=3",
+			wantStatus: http.StatusOK,
+			wantIDs:    "m7,m8,m9",
+			wantMore:   true,
+			wantCursor: "7",
+		},
+		{
+			name:       "default limit returns everything",
+			wantStatus: http.StatusOK,
+			wantIDs:    "m0,m1,m2,m3,m4,m5,m6,m7,m8,m9",
+		},
+		{
+			name:       "before an index",
+			query:      "?limit=3&before=7",
+			wantStatus: http.StatusOK,
+			wantIDs:    "m4,m5,m6",
+			wantMore:   true,
+			wantCursor: "4",
+		},
+		{
+			name:       "before the first index",
+			query:      "?before=2",
+			wantStatus: http.StatusOK,
+			wantIDs:    "m0,m1",
+		},
+		{
+			name:       "before a time",
+			query:      "?limit=2&before=" + at(5),
+			wantStatus: http.StatusOK,
+			wantIDs:    "m3,m4",
+			wantMore:   true,
+			wantCursor: "3",
+		},
+		{
+			name:       "sender filter pages by timestamp",
+			query:      "?limit=2&sender=agent@example.com",
+			wantStatus: http.StatusOK,
+			wantIDs:    "m7,m9",
+			wantMore:   true,
+			wantCursor: base.Add(7 * time.Minute).Format(time.RFC3339Nano),
+		},
+		{
+			name:       "role filter before a time",
+			query:      "?limit=2&role=customer&before=" + at(7),
+			wantStatus: http.StatusOK,
+			wantIDs:    "m4,m6",
+			wantMore:   true,
+			wantCursor: base.Add(4 * time.Minute).Format(time.RFC3339Nano),
+		},
+		{
+			name:       "role filter last page",
+			query:      "?role=customer&before=" + at(3),
+			wantStatus: http.StatusOK,
+			wantIDs:    "m0,m2",
+		},
+		{
+			name:       "tops up from the archive",
+			query:      "?limit=4",
+			archive:    8,
+			wantStatus: http.StatusOK,
+			wantIDs:    "m6,m7,m8,m9",
+			wantMore:   true,
+			wantCursor: "6",
+		},
+		{
+			name:       "pages into the archive by index",
+			query:      "?limit=3&before=6",
+			archive:    8,
+			wantStatus: http.StatusOK,
+			wantIDs:    "m3,m4,m5",
+			wantMore:   true,
+			wantCursor: "3",
+		},
+		{
+			name:       "filtered archive page",
+			query:      "?limit=2&sender=agent@example.com&before=" + at(5),
+			archive:    8,
+			wantStatus: http.StatusOK,
+			wantIDs:    "m1,m3",
+		},
+		{
+			name:       "invalid limit",
+			query:      "?limit=0",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid cursor",
+			query:      "?before=yesterday",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			store.addChat(testChat("c1", 10, base))
+			if tt.archive > 0 {
+				// Archiving keeps 90% of the inline cap
+				defer func(limit int) { maxInlineMessages = limit }(maxInlineMessages)
+				maxInlineMessages = ((10-tt.archive)*10 + 8) / 9
+				if err := store.ArchiveOverflow(context.Background(), "c1", 10); err != nil {
+					t.Fatal(err)
+				}
+				if chat, _ := store.chat("c1"); chat.ArchivedCount != tt.archive {
+					t.Fatalf("archived %d messages, want %d", chat.ArchivedCount, tt.archive)
+				}
+			}
+
+			w := serve(http.MethodGet, "/chats/:chatId/history", "/chats/c1/history"+tt.query, nil, "", getChatHistory(store))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var got historyResponse
+			decodeEnvelope(t, w, &got)
+			if ids := messageIDs(got.Messages); ids != tt.wantIDs {
+				t.Errorf("messages = %s, want %s", ids, tt.wantIDs)
+			}
+			if got.HasMore != tt.wantMore || got.NextCursor != tt.wantCursor {
+				t.Errorf("hasMore %v cursor %q, want %v %q", got.HasMore, got.NextCursor, tt.wantMore, tt.wantCursor)
+			}
+		})
+	}
+}
+
+func TestGetChatHistoryErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		storeErr   error
+		wantStatus int
+		wantCode   string
+	}{
+		{"missing chat", nil, http.StatusNotFound, codeChatNotFound},
+		{"store error", errors.New("connection reset"), http.StatusInternalServerError, codeDatabaseError},
+		{"store timeout", context.DeadlineExceeded, http.StatusGatewayTimeout, codeDatabaseTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			store.fail(tt.storeErr)
+
+			w := serve(http.MethodGet, "/chats/:chatId/history", "/chats/c1/history", nil, "", getChatHistory(store))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if apiErr := decodeEnvelope(t, w, nil); apiErr == nil || apiErr.Code != tt.wantCode {
+				t.Errorf("error = %+v, want code %s", apiErr, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestReopenChat(t *testing.T) {
+	tests := []struct {
+		name       string
+		chat       *Chat
+		token      *Claims
+		wantStatus int
+		wantBy     string
+	}{
+		{
+			name:       "reopened by the authenticated user",
+			chat:       &Chat{ChatID: "c1", UserEmail: "user@example.com", Status: "ended"},
+			token:      &Claims{Email: "agent@example.com", Role: roleAdmin},
+			wantStatus: http.StatusOK,
+			wantBy:     "agent@example.com",
+		},
+		{
+			name:       "the query parameter is ignored",
+			chat:       &Chat{ChatID: "c1", UserEmail: "user@example.com", Status: "ended"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "active chat",
+			chat:       &Chat{ChatID: "c1", UserEmail: "user@example.com"},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "missing chat",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			if tt.chat != nil {
+				store.addChat(*tt.chat)
+			}
+			token := ""
+			if tt.token != nil {
+				token = testToken(t, *tt.token)
+			}
+
+			w := serve(http.MethodPost, "/reopenChat/:chatId", "/reopenChat/c1?reopenedBy=spoofed@example.com", nil, token, reopenChat(store))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			chat, _ := store.chat("c1")
+			if chat.Status != "active" || chat.ReopenedBy != tt.wantBy {
+				t.Errorf("status %q reopenedBy %q, want active by %q", chat.Status, chat.ReopenedBy, tt.wantBy)
+			}
+		})
+	}
+}
+
+func TestGetMessagesSince(t *testing.T) {
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	total := maxReplayMessages + 50
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantFirst  string
+		wantCount  int
+		wantMore   bool
+	}{
+		{"oldest page after a time", "?since=" + base.Format(time.RFC3339), http.StatusOK, "m1", maxReplayMessages, true},
+		{"next page after a message", "?after=m200", http.StatusOK, "m201", total - maxReplayMessages - 1, false},
+		{"nothing new", "?after=m249", http.StatusOK, "", 0, false},
+		{"missing cursor", "", http.StatusBadRequest, "", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			store.addChat(testChat("c1", total, base))
+
+			w := serve(http.MethodGet, "/chat/:chatId/messages", "/chat/c1/messages"+tt.query, nil, "", getMessagesSince(store))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var got struct {
+				Messages []ChatMessage `json:"messages"`
+				HasMore  bool          `json:"hasMore"`
+			}
+			decodeEnvelope(t, w, &got)
+			if len(got.Messages) != tt.wantCount || got.HasMore != tt.wantMore {
+				t.Fatalf("%d messages, hasMore %v; want %d, %v", len(got.Messages), got.HasMore, tt.wantCount, tt.wantMore)
+			}
+			if len(got.Messages) > 0 && got.Messages[0].MsgID != tt.wantFirst {
+				t.Errorf("first message = %s, want %s", got.Messages[0].MsgID, tt.wantFirst)
+			}
+		})
+	}
+}
+
+func TestListingsFailOnCursorError(t *testing.T) {
+	user := testToken(t, Claims{Email: "user@example.com"})
+	admin := testToken(t, Claims{Email: "agent@example.com", Role: roleAdmin})
+
+	tests := []struct {
+		name    string
+		route   string
+		path    string
+		token   string
+		handler func(ChatStore) gin.HandlerFunc
+	}{
+		{"active chats of a user", "/user/activeChats/:userEmail", "/user/activeChats/user@example.com", user, getUserActiveChats},
+		{"ended chats of a user", "/user/endedChats/:userEmail", "/user/endedChats/user@example.com", user, getUserEndedChats},
+		{"active chats", "/getActiveChats", "/getActiveChats", admin, getActiveChats},
+		{"chat list", "/chats", "/chats", admin, listChats},
+		{"search", "/search", "/search?q=refund", user, searchChats},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			store.addChat(testChat("c1", 2, time.Now()))
+			store.fail(errors.New("cursor killed"))
+
+			w := serve(http.MethodGet, tt.route, tt.path, nil, tt.token, tt.handler(store))
+			if w.Code != http.StatusInternalServerError {
+				t.Fatalf("status = %d, want 500: %s", w.Code, w.Body)
+			}
+			if apiErr := decodeEnvelope(t, w, nil); apiErr == nil || apiErr.Code != codeDatabaseError {
+				t.Errorf("error = %+v, want %s", apiErr, codeDatabaseError)
+			}
+		})
+	}
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Message size limits
+var (
+	maxFrameBytes   = int64(getEnvInt("MAX_FRAME_BYTES", 64*1024)) // Largest inbound WebSocket frame
+	maxMessageChars = getEnvInt("MAX_MESSAGE_CHARS", 4000)         // Longest message text, in characters
+)
+
+// Keep the text a message had before each edit (MESSAGE_EDIT_HISTORY).
+// Off by default since every edit grows the chat document.
+var keepEditHistory = getEnv("MESSAGE_EDIT_HISTORY", "false") == "true"
+
+// EditRecord is the text a message had before one of its edits
+type EditRecord struct {
+	Message  string    `bson:"message" json:"message"`
+	EditedAt time.Time `bson:"editedAt" json:"editedAt"`
+}
+
+var (
+	errMessageNotFound  = errors.New("message not found")
+	errMessageArchived  = errors.New("message is archived and can no longer be changed")
+	errNotMessageOwner  = errors.New("only the sender can change this message")
+	errEmptyMessage     = errors.New("message is empty")
+	errMessageTooLong   = errors.New("message is too long")
+	errDuplicateMessage = errors.New("message was already sent")
+	errChatClosed       = errors.New("chat is closed")
+)
+
+// Longest display name, in characters
+const maxDisplayNameChars = 64
+
+var errInvalidDisplayName = errors.New("displayName must be at most 64 characters")
+
+// Check a new message before it is persisted and return it as it will be
+// stored, with blocked words masked. Text may only be empty when the message
+// carries attachments. Sends and "validate" frames both go through here.
+func validateNewMessage(chatID string, msg ChatMessage) (ChatMessage, error) {
+	if err := validateAttachments(chatID, msg.Attachments); err != nil {
+		return msg, err
+	}
+	if len(msg.Attachments) == 0 || msg.Message != "" {
+		if err := validateMessage(msg.Message); err != nil {
+			return msg, err
+		}
+	}
+	text, err := filterProfanity(msg.Message)
+	if err != nil {
+		return msg, err
+	}
+	msg.Message = text
+	return msg, nil
+}
+
+// Tell a client its message failed validation: a validation result for a
+// "validate" frame, an error for a real send
+func reportInvalidMessage(client *Client, validateOnly bool, clientMsgID string, err error) {
+	if validateOnly {
+		registry.Send(client, ValidationEvent{Type: "validation", ClientMsgID: clientMsgID, Valid: false, Error: err.Error()})
+		return
+	}
+	registry.Send(client, ErrorEvent{Type: "error", Error: err.Error()})
+}
+
+// Pick the name for a connection's messages: the one sent in init, else the
+// token's name, else the email
+func resolveDisplayName(requested string, claims *Claims) (string, error) {
+	requested = strings.TrimSpace(requested)
+	if requested == "" {
+		return claims.DisplayName(), nil
+	}
+	if utf8.RuneCountInString(requested) > maxDisplayNameChars {
+		return "", errInvalidDisplayName
+	}
+	return requested, nil
+}
+
+// Check the new text of an edited message, masked when the profanity filter
+// masks. Like new messages, edits are filtered before they reach the store.
+func validateEdit(text string) (string, error) {
+	if err := validateMessage(text); err != nil {
+		return text, err
+	}
+	return filterProfanity(text)
+}
+
+// Check message text before it is persisted
+func validateMessage(text string) error {
+	if strings.TrimSpace(text) == "" {
+		return errEmptyMessage
+	}
+	if utf8.RuneCountInString(text) > maxMessageChars {
+		return errMessageTooLong
+	}
+	return nil
+}
+
+// MessageEvent announces a change to an existing message
+type MessageEvent struct {
+	Type    string      `json:"type"` // "edit", "delete", "pin", "unpin" or "attach"
+	Message ChatMessage `json:"message"`
+}
+
+func (s *mongoStore) FindMessage(ctx context.Context, chatID, msgID string) (ChatMessage, error) {
+	return s.findMessageBy(ctx, chatID, "msgId", msgID)
+}
+
+func (s *mongoStore) FindMessageByClientID(ctx context.Context, chatID, clientMsgID string) (ChatMessage, error) {
+	return s.findMessageBy(ctx, chatID, "clientMsgId", clientMsgID)
+}
+
+// Find the first message of a chat whose field has the given value
+func (s *mongoStore) findMessageBy(ctx context.Context, chatID, field, value string) (ChatMessage, error) {
+	var chat Chat
+	filter := bson.M{"chatId": chatID, "messages." + field: value}
+	projection := options.FindOne().SetProjection(bson.M{"messages.$": 1})
+
+	err := s.chats.FindOne(ctx, filter, projection).Decode(&chat)
+	if err == mongo.ErrNoDocuments {
+		archived, err := s.findArchivedMessage(ctx, chatID, field, value)
+		if err == mongo.ErrNoDocuments {
+			return ChatMessage{}, errMessageNotFound
+		}
+		if err != nil {
+			return ChatMessage{}, err
+		}
+		return archived.ChatMessage, errMessageArchived
+	}
+	if err != nil {
+		return ChatMessage{}, err
+	}
+	return chat.Messages[0], nil
+}
+
+func (s *mongoStore) EditMessage(ctx context.Context, chatID, msgID, sender, text string, at time.Time, previous *EditRecord) error {
+	// lastMessage is a copy of the latest message, so it is edited along with it.
+	// Texts are $literal so ones starting with $ aren't read as field paths.
+	edited := func(ref string) bson.M {
+		change := bson.M{"message": bson.M{"$literal": text}, "editedAt": at}
+		if previous != nil {
+			change["editHistory"] = bson.M{"$concatArrays": bson.A{
+				bson.M{"$ifNull": bson.A{ref + ".editHistory", bson.A{}}},
+				bson.A{bson.M{"$literal": *previous}},
+			}}
+		}
+		return bson.M{"$cond": bson.A{
+			bson.M{"$and": bson.A{
+				bson.M{"$eq": bson.A{ref + ".msgId", msgID}},
+				bson.M{"$eq": bson.A{ref + ".sender", sender}},
+			}},
+			bson.M{"$mergeObjects": bson.A{ref, change}},
+			ref,
+		}}
+	}
+	filter := bson.M{"chatId": chatID, "messages": bson.M{"$elemMatch": bson.M{"msgId": msgID, "sender": sender}}}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"messages":    bson.M{"$map": bson.M{"input": "$messages", "as": "m", "in": edited("$$m")}},
+			"lastMessage": edited("$lastMessage"),
+		}}},
+	}
+	_, err := s.chats.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// Replace the text of a message. Only the original sender may edit it.
+func editMessage(ctx context.Context, store ChatStore, chatID, msgID, editor, text string) (ChatMessage, error) {
+	msg, err := store.FindMessage(ctx, chatID, msgID)
+	if err != nil {
+		return msg, err
+	}
+	if msg.Deleted {
+		return msg, errMessageNotFound
+	}
+	if msg.Sender != editor {
+		return msg, errNotMessageOwner
+	}
+
+	now := time.Now().UTC()
+	var previous *EditRecord
+	if keepEditHistory {
+		previous = &EditRecord{Message: msg.Message, EditedAt: now}
+	}
+	if err := store.EditMessage(ctx, chatID, msgID, editor, text, now, previous); err != nil {
+		return msg, err
+	}
+
+	msg.Message = text
+	msg.EditedAt = &now
+	return msg, nil
+}
+
+// Get the earlier texts of a message, oldest first (admins only)
+func getMessageHistory(store ChatStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := authenticate(c.Request)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+		if !claims.IsAdmin() {
+			respondError(c, http.StatusForbidden, codeForbidden, "Admin role required")
+			return
+		}
+
+		chatID := c.Param("chatId")
+		msgID := c.Param("messageId")
+
+		ctx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+
+		msg, err := store.FindMessage(ctx, chatID, msgID)
+		if err == errMessageNotFound {
+			respondError(c, http.StatusNotFound, codeMessageNotFound, "message not found")
+			return
+		}
+		if err != nil && err != errMessageArchived {
+			slog.Error("Error fetching message history", "event", "message_history", "chatId", chatID, "msgId", msgID, "error", err)
+			respondDBError(c, err, "Database error")
+			return
+		}
+		history := msg.EditHistory
+		if history == nil {
+			history = []EditRecord{}
+		}
+
+		respond(c, http.StatusOK, gin.H{"msgId": msg.MsgID, "message": msg.Message, "editedAt": msg.EditedAt, "history": history})
+	}
+}
+
+// Mark every message of a chat read by the caller in one update. Repeating it
+// changes nothing, so clients may call it each time a chat is opened.
+func markChatRead(store ChatStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := authenticate(c.Request)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+		chatID := c.Param("chatId")
+
+		// Customers can only mark their own chat
+		owner := ""
+		if !claims.IsAdmin() {
+			owner = claims.Email
+		}
+
+		ctx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+
+		found, changed, err := store.MarkAllRead(ctx, chatID, claims.Email, owner)
+		if err != nil {
+			slog.Error("Error marking chat read", "event", "read_receipt", "chatId", chatID, "userEmail", claims.Email, "error", err)
+			respondDBError(c, err, "Could not mark chat read")
+			return
+		}
+		if !found {
+			respondError(c, http.StatusNotFound, codeChatNotFound, "chat not found")
+			return
+		}
+
+		if changed {
+			broadcastEvent(chatID, ReceiptEvent{Type: "read", MessageIDs: []string{}, ReadBy: claims.Email, All: true}, nil)
+		}
+
+		respond(c, http.StatusOK, gin.H{"chatId": chatID, "readBy": claims.Email, "unreadCount": 0})
+	}
+}
+
+// Edit a message over REST
+func updateMessage(store ChatStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := authenticate(c.Request)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		chatID := c.Param("chatId")
+		msgID := c.Param("messageId")
+
+		var body struct {
+			Message string `json:"message"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "message is required")
+			return
+		}
+		text, err := validateEdit(body.Message)
+		if errors.Is(err, errBlockedWords) {
+			respondError(c, http.StatusUnprocessableEntity, codeBlockedWords, err.Error())
+			return
+		}
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+
+		ctx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+
+		msg, err := editMessage(ctx, store, chatID, msgID, claims.Email, text)
+		switch {
+		case err == errMessageNotFound:
+			respondError(c, http.StatusNotFound, codeMessageNotFound, "message not found")
+			return
+		case err == errNotMessageOwner:
+			respondError(c, http.StatusForbidden, codeForbidden, err.Error())
+			return
+		case err == errMessageArchived:
+			respondError(c, http.StatusConflict, codeMessageArchived, err.Error())
+			return
+		case err != nil:
+			slog.Error("Error editing message", "event", "message_edit", "chatId", chatID, "userEmail", claims.Email, "error", err)
+			respondDBError(c, err, "Could not edit message")
+			return
+		}
+
+		broadcastEvent(chatID, MessageEvent{Type: "edit", Message: msg}, nil)
+		respond(c, http.StatusOK, msg)
+	}
+}
+
+// Soft-delete a message: flag it and blank its text but keep its place in the
+// array so ordering and receipts stay intact. Allowed for the sender or an admin.
+func deleteMessage(ctx context.Context, store ChatStore, chatID, msgID string, requester *Claims) (ChatMessage, error) {
+	msg, err := store.FindMessage(ctx, chatID, msgID)
+	if err != nil {
+		return msg, err
+	}
+	if msg.Sender != requester.Email && !requester.IsAdmin() {
+		return msg, errNotMessageOwner
+	}
+
+	if err := store.DeleteMessage(ctx, chatID, msgID); err != nil {
+		return msg, err
+	}
+
+	msg.Deleted = true
+	msg.Message = ""
+	msg.Pinned = false
+	return msg, nil
+}
+
+// Soft-delete a message over REST
+func removeMessage(store ChatStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := authenticate(c.Request)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		ctx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+
+		chatID := c.Param("chatId")
+		msg, err := deleteMessage(ctx, store, chatID, c.Param("messageId"), claims)
+		switch {
+		case err == errMessageNotFound:
+			respondError(c, http.StatusNotFound, codeMessageNotFound, "message not found")
+			return
+		case err == errNotMessageOwner:
+			respondError(c, http.StatusForbidden, codeForbidden, err.Error())
+			return
+		case err == errMessageArchived:
+			respondError(c, http.StatusConflict, codeMessageArchived, err.Error())
+			return
+		case err != nil:
+			slog.Error("Error deleting message", "event", "message_delete", "chatId", chatID, "userEmail", claims.Email, "error", err)
+			respondDBError(c, err, "Could not delete message")
+			return
+		}
+
+		broadcastEvent(chatID, MessageEvent{Type: "delete", Message: msg}, nil)
+		respond(c, http.StatusOK, msg)
+	}
+}
+
+// Longest emoji key accepted for a reaction, in bytes
+const maxEmojiBytes = 32
+
+var (
+	errInvalidEmoji   = errors.New("invalid emoji")
+	errNotParticipant = errors.New("only chat participants can join this chat")
+)
+
+// ReactionEvent carries the reactions of a message after one was toggled
+type ReactionEvent struct {
+	Type      string              `json:"type"` // always "reaction"
+	MessageID string              `json:"messageId"`
+	Reactions map[string][]string `json:"reactions"`
+}
+
+// Emoji are stored as document keys, so they can't contain dots or start with $
+func validateEmoji(emoji string) error {
+	if emoji == "" || len(emoji) > maxEmojiBytes || !utf8.ValidString(emoji) ||
+		strings.ContainsAny(emoji, ".$") || strings.TrimSpace(emoji) != emoji {
+		return errInvalidEmoji
+	}
+	return nil
+}
+
+func (s *mongoStore) ToggleReaction(ctx context.Context, chatID, msgID, userEmail, emoji string) error {
+	field := "reactions." + emoji
+	path := "messages.$." + field
+
+	// Remove the reaction if the user has it
+	reacted := bson.M{"chatId": chatID, "messages": bson.M{"$elemMatch": bson.M{"msgId": msgID, "deleted": bson.M{"$ne": true}, field: userEmail}}}
+	result, err := s.chats.UpdateOne(ctx, reacted, bson.M{"$pull": bson.M{path: userEmail}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount > 0 {
+		// Drop the emoji once nobody reacts with it anymore
+		empty := bson.M{"chatId": chatID, "messages": bson.M{"$elemMatch": bson.M{"msgId": msgID, field: bson.M{"$size": 0}}}}
+		_, err := s.chats.UpdateOne(ctx, empty, bson.M{"$unset": bson.M{path: ""}})
+		return err
+	}
+
+	filter := bson.M{"chatId": chatID, "messages": bson.M{"$elemMatch": bson.M{"msgId": msgID, "deleted": bson.M{"$ne": true}}}}
+	result, err = s.chats.UpdateOne(ctx, filter, bson.M{"$addToSet": bson.M{path: userEmail}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errMessageNotFound
+	}
+	return nil
+}
+
+// Toggle the user's reaction on a message and return the message with its
+// updated reactions
+func toggleReaction(ctx context.Context, store ChatStore, chatID, msgID, userEmail, emoji string) (ChatMessage, error) {
+	err := store.ToggleReaction(ctx, chatID, msgID, userEmail, emoji)
+	if err == errMessageNotFound {
+		// Tell an archived message apart from a missing one
+		if _, findErr := store.FindMessage(ctx, chatID, msgID); findErr == errMessageArchived {
+			err = findErr
+		}
+	}
+	if err != nil {
+		return ChatMessage{}, err
+	}
+	return store.FindMessage(ctx, chatID, msgID)
+}
+
+// Longest quoted text kept on a reply, in characters
+const replySnippetChars = 100
+
+var errInvalidReply = errors.New("replyTo must reference a message in this chat")
+
+// ReplyPreview is the quoted message stored on a reply, so clients can render
+// the quote without fetching the original
+type ReplyPreview struct {
+	MsgID   string `bson:"msgId" json:"msgId"`
+	Sender  string `bson:"sender" json:"sender"`
+	Snippet string `bson:"snippet" json:"snippet"`
+}
+
+// Check that msg.ReplyTo names a message of the same chat and attach its preview.
+// Messages without ReplyTo are left alone.
+func resolveReply(ctx context.Context, store ChatStore, chatID string, msg *ChatMessage) error {
+	if msg.ReplyTo == "" {
+		return nil
+	}
+	// Archived messages can still be quoted
+	quoted, err := store.FindMessage(ctx, chatID, msg.ReplyTo)
+	if err == errMessageNotFound {
+		return errInvalidReply
+	}
+	if err != nil && err != errMessageArchived {
+		return err
+	}
+
+	snippet := quoted.Message
+	if runes := []rune(snippet); len(runes) > replySnippetChars {
+		snippet = string(runes[:replySnippetChars]) + "…"
+	}
+	msg.ReplyPreview = &ReplyPreview{MsgID: quoted.MsgID, Sender: quoted.Sender, Snippet: snippet}
+	return nil
+}
+
+func (s *mongoStore) DeleteMessage(ctx context.Context, chatID, msgID string) error {
+	// The message's copies go too: lastMessage when it is the latest, and the
+	// quoted snippet on its replies. Deleted messages drop out of the pins.
+	deleted := func(ref string) bson.M {
+		return bson.M{"$switch": bson.M{
+			"branches": bson.A{
+				bson.M{
+					"case": bson.M{"$eq": bson.A{ref + ".msgId", msgID}},
+					"then": bson.M{"$mergeObjects": bson.A{ref, bson.M{"deleted": true, "message": "", "pinned": false}}},
+				},
+				bson.M{
+					"case": bson.M{"$eq": bson.A{ref + ".replyPreview.msgId", msgID}},
+					"then": bson.M{"$mergeObjects": bson.A{ref, bson.M{"replyPreview": bson.M{"$mergeObjects": bson.A{ref + ".replyPreview", bson.M{"snippet": ""}}}}}},
+				},
+			},
+			"default": ref,
+		}}
+	}
+	filter := bson.M{"chatId": chatID, "messages.msgId": msgID}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"messages":    bson.M{"$map": bson.M{"input": "$messages", "as": "m", "in": deleted("$$m")}},
+			"lastMessage": deleted("$lastMessage"),
+		}}},
+	}
+	_, err := s.chats.UpdateOne(ctx, filter, update)
+	return err
+}
+
+func (s *mongoStore) MarkRead(ctx context.Context, chatID string, msgIDs []string, reader string) error {
+	filter := bson.M{"chatId": chatID}
+	update := bson.M{"$addToSet": bson.M{"messages.$[m].readBy": reader}}
+	options := options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: []interface{}{bson.M{"m.msgId": bson.M{"$in": msgIDs}}},
+	})
+	_, err := s.chats.UpdateOne(ctx, filter, update, options)
+	return err
+}
+
+func (s *mongoStore) MarkAllRead(ctx context.Context, chatID, reader, owner string) (bool, bool, error) {
+	filter := bson.M{"chatId": chatID}
+	if owner != "" {
+		filter["userEmail"] = owner
+	}
+	update := bson.M{"$addToSet": bson.M{"messages.$[].readBy": reader}}
+	result, err := s.chats.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, false, err
+	}
+	return result.MatchedCount > 0, result.ModifiedCount > 0, nil
+}
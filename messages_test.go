@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestArchivedMessages(t *testing.T) {
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	owner := testToken(t, Claims{Email: "user@example.com"})
+	admin := testToken(t, Claims{Email: "agent@example.com", Role: roleAdmin})
+
+	tests := []struct {
+		name       string
+		method     string
+		route      string
+		path       string
+		body       string
+		token      string
+		handler    func(ChatStore) gin.HandlerFunc
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name: "edit", method: http.MethodPatch, route: "/chat/:chatId/message/:messageId", path: "/chat/c1/message/m0",
+			body: `{"message":"changed"}`, token: owner, handler: updateMessage,
+			wantStatus: http.StatusConflict, wantCode: codeMessageArchived,
+		},
+		{
+			name: "delete", method: http.MethodDelete, route: "/chat/:chatId/message/:messageId", path: "/chat/c1/message/m0",
+			token: owner, handler: removeMessage,
+			wantStatus: http.StatusConflict, wantCode: codeMessageArchived,
+		},
+		{
+			name: "pin", method: http.MethodPost, route: "/chat/:chatId/message/:messageId/pin", path: "/chat/c1/message/m0/pin",
+			token: admin, handler: pinMessage,
+			wantStatus: http.StatusConflict, wantCode: codeMessageArchived,
+		},
+		{
+			name: "edit history is readable", method: http.MethodGet, route: "/chat/:chatId/message/:messageId/history", path: "/chat/c1/message/m0/history",
+			token: admin, handler: getMessageHistory,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "missing message", method: http.MethodPatch, route: "/chat/:chatId/message/:messageId", path: "/chat/c1/message/nope",
+			body: `{"message":"changed"}`, token: owner, handler: updateMessage,
+			wantStatus: http.StatusNotFound, wantCode: codeMessageNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			store.addChat(testChat("c1", 4, base))
+			store.archive("c1", 2)
+
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			w := serve(tt.method, tt.route, tt.path, body, tt.token, tt.handler(store))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if apiErr := decodeEnvelope(t, w, nil); tt.wantCode != "" && (apiErr == nil || apiErr.Code != tt.wantCode) {
+				t.Errorf("error = %+v, want code %s", apiErr, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestReplyToArchivedMessage(t *testing.T) {
+	store := newFakeStore()
+	store.addChat(testChat("c1", 4, time.Now()))
+	store.archive("c1", 2)
+
+	msg := ChatMessage{Message: "about that", ReplyTo: "m0"}
+	if err := resolveReply(context.Background(), store, "c1", &msg); err != nil {
+		t.Fatalf("resolveReply: %v", err)
+	}
+	if msg.ReplyPreview == nil || msg.ReplyPreview.MsgID != "m0" {
+		t.Errorf("reply preview = %+v, want the archived message", msg.ReplyPreview)
+	}
+}
+
+func TestMessagesSinceAcrossArchive(t *testing.T) {
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		query   string
+		wantIDs string
+	}{
+		{"after an archived message", "?after=m1", "m2,m3,m4,m5"},
+		{"after the last archived message", "?after=m2", "m3,m4,m5"},
+		{"after a time in the archive", "?since=" + base.Add(30*time.Second).Format(time.RFC3339), "m1,m2,m3,m4,m5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			store.addChat(testChat("c1", 6, base))
+			store.archive("c1", 3)
+
+			w := serve(http.MethodGet, "/chat/:chatId/messages", "/chat/c1/messages"+tt.query, nil, "", getMessagesSince(store))
+			var got struct {
+				Messages []ChatMessage `json:"messages"`
+			}
+			decodeEnvelope(t, w, &got)
+			if ids := messageIDs(got.Messages); ids != tt.wantIDs {
+				t.Errorf("messages = %s, want %s", ids, tt.wantIDs)
+			}
+		})
+	}
+}
+
+// The chat's lastMessage as GET /chat/:chatId and the /chats listing return it
+func listedLastMessages(t *testing.T, store ChatStore, chatID, token string) (fromChat, fromList ChatMessage) {
+	t.Helper()
+	w := serve(http.MethodGet, "/chat/:chatId", "/chat/"+chatID, nil, token, getChat(store))
+	var chat Chat
+	if apiErr := decodeEnvelope(t, w, &chat); apiErr != nil {
+		t.Fatalf("getChat: %+v", apiErr)
+	}
+
+	w = serve(http.MethodGet, "/chats", "/chats", nil, "", listChats(store))
+	var list struct{ Chats []Chat }
+	if apiErr := decodeEnvelope(t, w, &list); apiErr != nil {
+		t.Fatalf("listChats: %+v", apiErr)
+	}
+	for _, listed := range list.Chats {
+		if listed.ChatID == chatID {
+			return chat.LastMessage, listed.LastMessage
+		}
+	}
+	t.Fatalf("chat %s is not listed", chatID)
+	return
+}
+
+func TestDeleteLatestMessage(t *testing.T) {
+	useTestRegistry(t)
+	store := newFakeStore()
+	chat := testChat("c1", 3, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	chat.Messages[2].Pinned = true
+	store.addChat(chat)
+	owner := testToken(t, Claims{Email: "user@example.com"})
+
+	w := serve(http.MethodDelete, "/chat/:chatId/message/:messageId", "/chat/c1/message/m2", nil, owner, removeMessage(store))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+
+	fromChat, fromList := listedLastMessages(t, store, "c1", owner)
+	for source, last := range map[string]ChatMessage{"getChat": fromChat, "listChats": fromList} {
+		if last.MsgID != "m2" || !last.Deleted || last.Message != "" {
+			t.Errorf("%s lastMessage = %+v, want m2 deleted and blank", source, last)
+		}
+	}
+	if pinned, _ := store.PinnedMessages(context.Background(), "c1"); len(pinned) != 0 {
+		t.Errorf("pinned = %v, want the deleted message unpinned", pinned)
+	}
+}
+
+func TestDeleteBlanksReplyPreviews(t *testing.T) {
+	store := newFakeStore()
+	store.addChat(testChat("c1", 2, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)))
+	reply := ChatMessage{Sender: "agent@example.com", SenderRole: roleAdmin, Message: "about that", ReplyTo: "m0"}
+	if err := resolveReply(context.Background(), store, "c1", &reply); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := saveMessage(context.Background(), store, "c1", reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := deleteMessage(context.Background(), store, "c1", "m0", &Claims{Email: "user@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, _ := store.FindMessage(context.Background(), "c1", saved.MsgID)
+	if preview := stored.ReplyPreview; preview == nil || preview.MsgID != "m0" || preview.Snippet != "" {
+		t.Errorf("reply preview = %+v, want m0 with a blank snippet", preview)
+	}
+	chat, _ := store.GetChat(context.Background(), "c1")
+	if preview := chat.LastMessage.ReplyPreview; preview == nil || preview.Snippet != "" {
+		t.Errorf("lastMessage reply preview = %+v, want a blank snippet", preview)
+	}
+}
+
+func TestEditLatestMessage(t *testing.T) {
+	useTestRegistry(t)
+	store := newFakeStore()
+	store.addChat(testChat("c1", 3, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)))
+	owner := testToken(t, Claims{Email: "user@example.com"})
+
+	body := strings.NewReader(`{"message":"message 2, corrected"}`)
+	w := serve(http.MethodPatch, "/chat/:chatId/message/:messageId", "/chat/c1/message/m2", body, owner, updateMessage(store))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+
+	fromChat, fromList := listedLastMessages(t, store, "c1", owner)
+	for source, last := range map[string]ChatMessage{"getChat": fromChat, "listChats": fromList} {
+		if last.MsgID != "m2" || last.Message != "message 2, corrected" || last.EditedAt == nil {
+			t.Errorf("%s lastMessage = %+v, want the edited m2", source, last)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Metadata limits
+const (
+	maxMetadataKeys     = 50
+	maxMetadataKeyChars = 64
+	maxMetadataDepth    = 5       // Objects and arrays nested inside a value
+	maxMetadataBytes    = 8 << 10 // Encoded as BSON, the whole metadata after a patch
+	maxMetadataRetries  = 3       // Patches that lost a race with another one
+)
+
+var (
+	errMetadataTooLarge = errors.New("metadata is too large")
+	errMetadataTooDeep  = errors.New("metadata values are nested too deeply")
+	errInvalidMetadata  = errors.New("metadata keys must be 1-64 characters without '.' or a leading '$'")
+	errMetadataConflict = errors.New("metadata was changed by another request")
+)
+
+// Keys become field names under metadata in MongoDB, so they can't hold
+// path separators or operators, at any depth
+func validateMetadata(metadata map[string]interface{}) error {
+	if len(metadata) > maxMetadataKeys {
+		return errMetadataTooLarge
+	}
+	for key, value := range metadata {
+		if !validMetadataKey(key) {
+			return errInvalidMetadata
+		}
+		if err := validateMetadataValue(value, 1); err != nil {
+			return err
+		}
+	}
+	encoded, err := bson.Marshal(metadata)
+	if err != nil || len(encoded) > maxMetadataBytes {
+		return errMetadataTooLarge
+	}
+	return nil
+}
+
+func validMetadataKey(key string) bool {
+	return key != "" && len(key) <= maxMetadataKeyChars && !strings.HasPrefix(key, "$") && !strings.Contains(key, ".")
+}
+
+// Check the keys of nested objects. Stored metadata decodes as BSON types,
+// patches as JSON ones.
+func validateMetadataValue(value interface{}, depth int) error {
+	var nested []interface{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if !validMetadataKey(key) {
+				return errInvalidMetadata
+			}
+			nested = append(nested, item)
+		}
+	case primitive.M:
+		return validateMetadataValue(map[string]interface{}(v), depth)
+	case primitive.D:
+		for _, elem := range v {
+			if !validMetadataKey(elem.Key) {
+				return errInvalidMetadata
+			}
+			nested = append(nested, elem.Value)
+		}
+	case []interface{}:
+		nested = v
+	case primitive.A:
+		nested = v
+	default:
+		return nil
+	}
+	if depth > maxMetadataDepth {
+		return errMetadataTooDeep
+	}
+	for _, item := range nested {
+		if err := validateMetadataValue(item, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get a chat's metadata (admins only)
+func getChatMetadata(store ChatStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := authenticate(c.Request)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+		if !claims.IsAdmin() {
+			respondError(c, http.StatusForbidden, codeForbidden, "Admin role required")
+			return
+		}
+		chatID := c.Param("chatId")
+
+		ctx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+
+		chat, err := store.GetChat(ctx, chatID)
+		if err == mongo.ErrNoDocuments {
+			respondError(c, http.StatusNotFound, codeChatNotFound, "chat not found")
+			return
+		}
+		if err != nil {
+			slog.Error("Error fetching chat metadata", "event", "chat_metadata", "chatId", chatID, "error", err)
+			respondDBError(c, err, "Database error")
+			return
+		}
+		if chat.Metadata == nil {
+			chat.Metadata = map[string]interface{}{}
+		}
+
+		respond(c, http.StatusOK, gin.H{"chatId": chatID, "metadata": chat.Metadata})
+	}
+}
+
+// Merge fields into a chat's metadata (admins only). A null value removes the key.
+func patchChatMetadata(store ChatStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := authenticate(c.Request)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+		if !claims.IsAdmin() {
+			respondError(c, http.StatusForbidden, codeForbidden, "Admin role required")
+			return
+		}
+		chatID := c.Param("chatId")
+
+		var patch map[string]interface{}
+		if err := c.ShouldBindJSON(&patch); err != nil || len(patch) == 0 {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "a JSON object of metadata fields is required")
+			return
+		}
+		if err := validateMetadata(patch); err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+
+		set := map[string]interface{}{}
+		var unset []string
+		for key, value := range patch {
+			if value == nil {
+				unset = append(unset, key)
+			} else {
+				set[key] = value
+			}
+		}
+
+		ctx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+
+		// The limits apply to the merged metadata, so a chat can't grow past
+		// them one patch at a time. The write only lands if no other patch
+		// came in since the read.
+		var metadata map[string]interface{}
+		for attempt := 1; ; attempt++ {
+			chat, err := store.GetChat(ctx, chatID)
+			if err == mongo.ErrNoDocuments {
+				respondError(c, http.StatusNotFound, codeChatNotFound, "chat not found")
+				return
+			}
+			if err != nil {
+				slog.Error("Error fetching chat metadata", "event", "chat_metadata", "chatId", chatID, "error", err)
+				respondDBError(c, err, "Database error")
+				return
+			}
+			merged := make(map[string]interface{}, len(chat.Metadata)+len(set))
+			for key, value := range chat.Metadata {
+				merged[key] = value
+			}
+			for key, value := range set {
+				merged[key] = value
+			}
+			for _, key := range unset {
+				delete(merged, key)
+			}
+			if err := validateMetadata(merged); err != nil {
+				respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+				return
+			}
+
+			metadata, err = store.UpdateMetadata(ctx, chatID, chat.MetadataRev, set, unset)
+			if errors.Is(err, errMetadataConflict) && attempt < maxMetadataRetries {
+				continue
+			}
+			if errors.Is(err, errMetadataConflict) {
+				respondError(c, http.StatusConflict, codeMetadataConflict, err.Error())
+				return
+			}
+			if err == mongo.ErrNoDocuments {
+				respondError(c, http.StatusNotFound, codeChatNotFound, "chat not found")
+				return
+			}
+			if err != nil {
+				slog.Error("Error updating chat metadata", "event", "chat_metadata", "chatId", chatID, "error", err)
+				respondDBError(c, err, "Could not update metadata")
+				return
+			}
+			break
+		}
+		if metadata == nil {
+			metadata = map[string]interface{}{}
+		}
+
+		respond(c, http.StatusOK, gin.H{"chatId": chatID, "metadata": metadata})
+	}
+}
+
+func (s *mongoStore) UpdateMetadata(ctx context.Context, chatID string, rev int64, set map[string]interface{}, unset []string) (map[string]interface{}, error) {
+	update := bson.M{"$inc": bson.M{"metadataRev": 1}}
+	if len(set) > 0 {
+		fields := bson.M{}
+		for key, value := range set {
+			fields["metadata."+key] = value
+		}
+		update["$set"] = fields
+	}
+	if len(unset) > 0 {
+		fields := bson.M{}
+		for _, key := range unset {
+			fields["metadata."+key] = ""
+		}
+		update["$unset"] = fields
+	}
+
+	var chat Chat
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(bson.M{"metadata": 1})
+	filter := bson.M{"chatId": chatID, "metadataRev": rev}
+	if rev == 0 {
+		// Chats that were never patched have no revision yet
+		filter["metadataRev"] = bson.M{"$in": bson.A{0, nil}}
+	}
+	err := s.chats.FindOneAndUpdate(ctx, filter, update, opts).Decode(&chat)
+	if err == mongo.ErrNoDocuments {
+		if count, countErr := s.chats.CountDocuments(ctx, bson.M{"chatId": chatID}); countErr == nil && count > 0 {
+			return nil, errMetadataConflict
+		}
+	}
+	return chat.Metadata, err
+}
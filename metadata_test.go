@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPatchChatMetadataValidation(t *testing.T) {
+	deep := `{"a":` + strings.Repeat(`[`, maxMetadataDepth+1) + strings.Repeat(`]`, maxMetadataDepth+1) + `}`
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{"nested object", `{"order":{"id":"A-1","items":[{"sku":"X"}]}}`, http.StatusOK},
+		{"operator in a nested key", `{"order":{"$where":"1"}}`, http.StatusBadRequest},
+		{"dotted key in an array", `{"items":[{"a.b":1}]}`, http.StatusBadRequest},
+		{"nested too deeply", deep, http.StatusBadRequest},
+	}
+
+	token := testToken(t, Claims{Email: "agent@example.com", Role: roleAdmin})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			store.addChat(Chat{ChatID: "c1", UserEmail: "user@example.com"})
+
+			w := serve(http.MethodPatch, "/chat/:chatId/metadata", "/chat/c1/metadata", strings.NewReader(tt.body), token, patchChatMetadata(store))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+func TestPatchChatMetadataTotalSize(t *testing.T) {
+	store := newFakeStore()
+	store.addChat(Chat{ChatID: "c1", UserEmail: "user@example.com"})
+	token := testToken(t, Claims{Email: "agent@example.com", Role: roleAdmin})
+	value := strings.Repeat("x", maxMetadataBytes/3)
+
+	patch := func(key string) int {
+		body := strings.NewReader(`{"` + key + `":"` + value + `"}`)
+		return serve(http.MethodPatch, "/chat/:chatId/metadata", "/chat/c1/metadata", body, token, patchChatMetadata(store)).Code
+	}
+	for _, key := range []string{"a", "b"} {
+		if code := patch(key); code != http.StatusOK {
+			t.Fatalf("patch %s: status = %d, want 200", key, code)
+		}
+	}
+	if code := patch("c"); code != http.StatusBadRequest {
+		t.Errorf("patch past the size limit: status = %d, want 400", code)
+	}
+	if chat, _ := store.chat("c1"); len(chat.Metadata) != 2 {
+		t.Errorf("stored %d keys, want 2", len(chat.Metadata))
+	}
+}
+
+// Lands another patch between each read and write
+type racingMetadataStore struct {
+	*fakeStore
+	races int
+}
+
+func (s *racingMetadataStore) UpdateMetadata(ctx context.Context, chatID string, rev int64, set map[string]interface{}, unset []string) (map[string]interface{}, error) {
+	if s.races > 0 {
+		s.races--
+		s.fakeStore.UpdateMetadata(ctx, chatID, rev, map[string]interface{}{"other": "value"}, nil)
+	}
+	return s.fakeStore.UpdateMetadata(ctx, chatID, rev, set, unset)
+}
+
+func TestPatchChatMetadataConflict(t *testing.T) {
+	tests := []struct {
+		name       string
+		races      int
+		wantStatus int
+	}{
+		{"retried after a race", 1, http.StatusOK},
+		{"gives up", maxMetadataRetries, http.StatusConflict},
+	}
+
+	token := testToken(t, Claims{Email: "agent@example.com", Role: roleAdmin})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &racingMetadataStore{fakeStore: newFakeStore(), races: tt.races}
+			store.addChat(Chat{ChatID: "c1", UserEmail: "user@example.com"})
+
+			w := serve(http.MethodPatch, "/chat/:chatId/metadata", "/chat/c1/metadata", strings.NewReader(`{"order":"A-1"}`), token, patchChatMetadata(store))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			chat, _ := store.chat("c1")
+			if _, ok := chat.Metadata["order"]; ok != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("metadata = %v", chat.Metadata)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, exposed on /metrics
+var (
+	messagesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_messages_received_total",
+		Help: "Chat messages received from clients.",
+	})
+	messagesSent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_messages_sent_total",
+		Help: "Chat messages persisted and sent to the chat's participants.",
+	})
+	chatsCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_chats_created_total",
+		Help: "Chats created.",
+	})
+	chatsClosed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_chats_closed_total",
+		Help: "Chats closed.",
+	})
+	upgradeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_websocket_upgrade_failures_total",
+		Help: "WebSocket upgrades that failed.",
+	})
+	webhookFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_webhook_failures_total",
+		Help: "Messages that could not be delivered to the webhook.",
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "chat_connected_clients",
+		Help: "WebSocket connections currently open.",
+	}, func() float64 { return float64(registry.Count()) })
+)
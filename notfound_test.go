@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Every lookup of a chat by ID answers 404 for a missing chat and keeps 5xx
+// for real database failures
+func TestChatLookupNotFoundVsError(t *testing.T) {
+	user := testToken(t, Claims{Email: "user@example.com"})
+	admin := testToken(t, Claims{Email: "agent@example.com", Role: roleAdmin})
+
+	routes := []struct {
+		name    string
+		method  string
+		route   string
+		path    string
+		body    string
+		token   string
+		handler func(ChatStore) gin.HandlerFunc
+	}{
+		{"chat", http.MethodGet, "/chat/:chatId", "/chat/c9", "", user, getChat},
+		{"history", http.MethodGet, "/chat/:chatId/history", "/chat/c9/history", "", user, getChatHistory},
+		{"metadata", http.MethodGet, "/chat/:chatId/metadata", "/chat/c9/metadata", "", admin, getChatMetadata},
+		{"post message", http.MethodPost, "/chat/:chatId/message", "/chat/c9/message", `{"message":"hi"}`, user, postMessage},
+		{"close", http.MethodPost, "/closeChat/:chatId", "/closeChat/c9", "", admin, closeChat},
+		{"reopen", http.MethodPost, "/reopenChat/:chatId", "/reopenChat/c9", "", admin, reopenChat},
+		{"export", http.MethodGet, "/chat/:chatId/export", "/chat/c9/export", "", admin, exportChat},
+		{"transfer", http.MethodPost, "/chat/:chatId/transfer", "/chat/c9/transfer", `{"to":"other@example.com","from":"agent@example.com"}`, admin, transferChat},
+	}
+
+	for _, rt := range routes {
+		for _, tt := range []struct {
+			name       string
+			storeErr   error
+			wantStatus int
+			wantCode   string
+		}{
+			{"missing", nil, http.StatusNotFound, codeChatNotFound},
+			{"store error", errors.New("connection reset"), http.StatusInternalServerError, codeDatabaseError},
+		} {
+			t.Run(rt.name+"/"+tt.name, func(t *testing.T) {
+				store := newFakeStore()
+				store.addChat(Chat{ChatID: "c1", UserEmail: "user@example.com"})
+				store.fail(tt.storeErr)
+
+				var body io.Reader
+				if rt.body != "" {
+					body = strings.NewReader(rt.body)
+				}
+				w := serve(rt.method, rt.route, rt.path, body, rt.token, rt.handler(store))
+				if w.Code != tt.wantStatus {
+					t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+				}
+				if apiErr := decodeEnvelope(t, w, nil); apiErr == nil || apiErr.Code != tt.wantCode {
+					t.Errorf("error = %+v, want code %s", apiErr, tt.wantCode)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{"missing origin", nil, "", true},
+		{"same host without a list", nil, "https://chat.example.com", true},
+		{"other host without a list", nil, "https://evil.example.net", false},
+		{"malformed origin", nil, "://", false},
+		{"listed origin", []string{"https://app.example.com"}, "https://app.example.com", true},
+		{"listed origin in another case", []string{"https://app.example.com"}, "HTTPS://APP.EXAMPLE.COM", true},
+		{"unlisted origin", []string{"https://app.example.com"}, "https://evil.example.net", false},
+		{"serving host not on the list", []string{"https://app.example.com"}, "https://chat.example.com", false},
+		{"missing origin with a list", []string{"https://app.example.com"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(origins []string) { allowedOrigins = origins }(allowedOrigins)
+			allowedOrigins = tt.allowed
+
+			req := httptest.NewRequest(http.MethodGet, "http://chat.example.com/ws", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if got := checkOrigin(req); got != tt.want {
+				t.Errorf("checkOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectRejectsDisallowedOrigin(t *testing.T) {
+	defer func(origins []string) { allowedOrigins = origins }(allowedOrigins)
+	allowedOrigins = []string{"https://app.example.com"}
+	url := startWS(t, newFakeStore())
+
+	for origin, wantStatus := range map[string]int{
+		"https://app.example.com":  http.StatusSwitchingProtocols,
+		"https://evil.example.net": http.StatusForbidden,
+	} {
+		header := http.Header{
+			"Authorization": {"Bearer " + testToken(t, Claims{Email: "user@example.com"})},
+			"Origin":        {origin},
+		}
+		ws, resp, _ := websocket.DefaultDialer.Dial(url, header)
+		if ws != nil {
+			ws.Close()
+		}
+		if resp == nil || resp.StatusCode != wantStatus {
+			t.Errorf("origin %s: response %v, want status %d", origin, resp, wantStatus)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Pagination describes the page a list endpoint returned
+type Pagination struct {
+	Total    int64 `json:"total"`
+	Page     int   `json:"page"` // 1-based, counted in pages of pageSize from skip
+	PageSize int   `json:"pageSize"`
+	HasMore  bool  `json:"hasMore"`
+}
+
+// Read limit/skip query parameters, capping limit at maxLimit.
+// Responds 400 and returns ok=false when either is malformed.
+func parsePagination(c *gin.Context, defaultLimit, maxLimit int) (limit, skip int, ok bool) {
+	limit = defaultLimit
+	if l := c.Query("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "limit must be a positive integer")
+			return 0, 0, false
+		}
+		limit = min(n, maxLimit)
+	}
+	if s := c.Query("skip"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "skip must be a non-negative integer")
+			return 0, 0, false
+		}
+		skip = n
+	}
+	return limit, skip, true
+}
+
+// Build the pagination object for a page and set the matching
+// X-Total-Count and Link (next/prev) headers
+func paginate(c *gin.Context, limit, skip int, total int64) Pagination {
+	hasMore := int64(skip+limit) < total
+
+	c.Header("X-Total-Count", strconv.FormatInt(total, 10))
+	var links []string
+	if hasMore {
+		links = append(links, pageLink(c.Request.URL, limit, skip+limit, "next"))
+	}
+	if skip > 0 {
+		links = append(links, pageLink(c.Request.URL, limit, max(skip-limit, 0), "prev"))
+	}
+	if len(links) > 0 {
+		c.Header("Link", strings.Join(links, ", "))
+	}
+
+	return Pagination{
+		Total:    total,
+		Page:     skip/limit + 1,
+		PageSize: limit,
+		HasMore:  hasMore,
+	}
+}
+
+// The request's own path and query with limit/skip swapped for another page
+func pageLink(u *url.URL, limit, skip int, rel string) string {
+	query := u.Query()
+	query.Set("limit", strconv.Itoa(limit))
+	query.Set("skip", strconv.Itoa(skip))
+	return "<" + u.Path + "?" + query.Encode() + `>; rel="` + rel + `"`
+}
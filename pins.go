@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func (s *mongoStore) SetPinned(ctx context.Context, chatID, msgID string, pinned bool) error {
+	filter := bson.M{"chatId": chatID, "messages.msgId": msgID}
+	update := bson.M{"$set": bson.M{"messages.$.pinned": true}}
+	if !pinned {
+		update = bson.M{"$unset": bson.M{"messages.$.pinned": ""}}
+	}
+	_, err := s.chats.UpdateOne(ctx, filter, update)
+	return err
+}
+
+func (s *mongoStore) PinnedMessages(ctx context.Context, chatID string) ([]ChatMessage, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"chatId": chatID}}},
+		{{Key: "$project", Value: bson.M{"messages": bson.M{"$filter": bson.M{
+			"input": bson.M{"$ifNull": bson.A{"$messages", bson.A{}}},
+			"as":    "m",
+			"cond":  bson.M{"$eq": bson.A{"$$m.pinned", true}},
+		}}}}},
+	}
+
+	cursor, err := s.chats.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var chat Chat
+	if !cursor.Next(ctx) {
+		if err := cursor.Err(); err != nil {
+			return nil, err
+		}
+		return nil, mongo.ErrNoDocuments
+	}
+	if err := cursor.Decode(&chat); err != nil {
+		return nil, err
+	}
+	return chat.Messages, nil
+}
+
+// Pin or unpin a message. Deleted messages can't be pinned.
+func setPinned(ctx context.Context, store ChatStore, chatID, msgID string, pinned bool) (ChatMessage, error) {
+	msg, err := store.FindMessage(ctx, chatID, msgID)
+	if err != nil {
+		return msg, err
+	}
+	if msg.Deleted {
+		return msg, errMessageNotFound
+	}
+	if err := store.SetPinned(ctx, chatID, msgID, pinned); err != nil {
+		return msg, err
+	}
+
+	msg.Pinned = pinned
+	return msg, nil
+}
+
+// Pin a message to the top of its chat (admins only)
+func pinMessage(store ChatStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		changePin(c, store, true)
+	}
+}
+
+// Unpin a message (admins only)
+func unpinMessage(store ChatStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		changePin(c, store, false)
+	}
+}
+
+func changePin(c *gin.Context, store ChatStore, pinned bool) {
+	claims, err := authenticate(c.Request)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+	if !claims.IsAdmin() {
+		respondError(c, http.StatusForbidden, codeForbidden, "Admin role required")
+		return
+	}
+
+	ctx, cancel := dbContext(c.Request.Context())
+	defer cancel()
+
+	chatID := c.Param("chatId")
+	msg, err := setPinned(ctx, store, chatID, c.Param("messageId"), pinned)
+	if err == errMessageNotFound {
+		respondError(c, http.StatusNotFound, codeMessageNotFound, "message not found")
+		return
+	}
+	if err == errMessageArchived {
+		respondError(c, http.StatusConflict, codeMessageArchived, err.Error())
+		return
+	}
+	if err != nil {
+		slog.Error("Error pinning message", "event", "message_pin", "chatId", chatID, "pinned", pinned, "error", err)
+		respondDBError(c, err, "Could not update pin")
+		return
+	}
+
+	eventType := "pin"
+	if !pinned {
+		eventType = "unpin"
+	}
+	broadcastEvent(chatID, MessageEvent{Type: eventType, Message: msg}, nil)
+	respond(c, http.StatusOK, msg)
+}
+
+// Get the pinned messages of a chat in chat order
+func getPinnedMessages(store ChatStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		chatID := c.Param("chatId")
+
+		ctx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+
+		messages, err := store.PinnedMessages(ctx, chatID)
+		if err == mongo.ErrNoDocuments {
+			respondError(c, http.StatusNotFound, codeChatNotFound, "chat not found")
+			return
+		}
+		if err != nil {
+			slog.Error("Database error while fetching pinned messages", "event", "message_pin", "chatId", chatID, "error", err)
+			respondDBError(c, err, "Database error")
+			return
+		}
+		if messages == nil {
+			messages = []ChatMessage{}
+		}
+
+		respond(c, http.StatusOK, gin.H{"chatId": chatID, "messages": messages})
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Profanity filter mode (PROFANITY_FILTER): "off", "mask" replaces blocked
+// words with asterisks, "reject" refuses the message
+var profanityMode = getEnv("PROFANITY_FILTER", "off")
+
+// Blocked words come from PROFANITY_WORDS (comma-separated) and the file at
+// PROFANITY_WORDS_FILE (one word per line, # starts a comment)
+var profanityWordsFile = getEnv("PROFANITY_WORDS_FILE", "")
+
+var errBlockedWords = errors.New("message contains blocked words")
+
+// Compiled word list; nil when no words are configured
+var (
+	profanityMu      sync.RWMutex
+	profanityPattern *regexp.Regexp
+)
+
+// Read the word list from the environment and file and swap it in
+func loadProfanityWords() (int, error) {
+	words := getEnvList("PROFANITY_WORDS")
+	if profanityWordsFile != "" {
+		fileWords, err := readWordFile(profanityWordsFile)
+		if err != nil {
+			return 0, err
+		}
+		words = append(words, fileWords...)
+	}
+
+	var pattern *regexp.Regexp
+	if len(words) > 0 {
+		quoted := make([]string, len(words))
+		for i, word := range words {
+			quoted[i] = regexp.QuoteMeta(word)
+		}
+		// \b only knows ASCII word characters, so spell out Unicode boundaries
+		pattern = regexp.MustCompile(`(?i)(?:^|[^\p{L}\p{N}_])(` + strings.Join(quoted, "|") + `)(?:$|[^\p{L}\p{N}_])`)
+	}
+
+	profanityMu.Lock()
+	profanityPattern = pattern
+	profanityMu.Unlock()
+	return len(words), nil
+}
+
+func readWordFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word != "" && !strings.HasPrefix(word, "#") {
+			words = append(words, word)
+		}
+	}
+	return words, scanner.Err()
+}
+
+// Apply the filter to message text: masked text in mask mode, errBlockedWords
+// in reject mode when a blocked word is found
+func filterProfanity(text string) (string, error) {
+	if profanityMode != "mask" && profanityMode != "reject" {
+		return text, nil
+	}
+	profanityMu.RLock()
+	pattern := profanityPattern
+	profanityMu.RUnlock()
+	if pattern == nil {
+		return text, nil
+	}
+	matches := findBlockedWords(pattern, text)
+	if len(matches) == 0 {
+		return text, nil
+	}
+	if profanityMode == "reject" {
+		return text, errBlockedWords
+	}
+
+	var masked strings.Builder
+	last := 0
+	for _, m := range matches {
+		masked.WriteString(text[last:m[0]])
+		masked.WriteString(strings.Repeat("*", utf8.RuneCountInString(text[m[0]:m[1]])))
+		last = m[1]
+	}
+	masked.WriteString(text[last:])
+	return masked.String(), nil
+}
+
+// Byte ranges of the blocked words in text. The pattern consumes the
+// characters around a word, so each search restarts right after the previous
+// word; ^ at the restart point is then only a boundary if the rune before is.
+func findBlockedWords(pattern *regexp.Regexp, text string) [][2]int {
+	var matches [][2]int
+	for pos := 0; pos < len(text); {
+		loc := pattern.FindStringSubmatchIndex(text[pos:])
+		if loc == nil {
+			break
+		}
+		start, end := pos+loc[2], pos+loc[3]
+		if start == pos && pos > 0 {
+			if r, _ := utf8.DecodeLastRuneInString(text[:pos]); isWordRune(r) {
+				_, size := utf8.DecodeRuneInString(text[pos:])
+				pos += size
+				continue
+			}
+		}
+		matches = append(matches, [2]int{start, end})
+		pos = end
+	}
+	return matches
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsNumber(r)
+}
+
+// Load the word list at startup and reload it on SIGHUP
+func startProfanityFilter() error {
+	if profanityMode == "off" {
+		return nil
+	}
+	if profanityMode != "mask" && profanityMode != "reject" {
+		return errors.New("PROFANITY_FILTER must be off, mask or reject")
+	}
+	count, err := loadProfanityWords()
+	if err != nil {
+		return err
+	}
+	slog.Info("Profanity filter enabled", "event", "profanity_load", "mode", profanityMode, "words", count)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadProfanityWords("signal")
+		}
+	}()
+	return nil
+}
+
+func reloadProfanityWords(source string) (int, error) {
+	count, err := loadProfanityWords()
+	if err != nil {
+		// Keep filtering with the previous list
+		slog.Error("Error reloading profanity word list", "event", "profanity_reload", "source", source, "error", err)
+		return 0, err
+	}
+	slog.Info("Profanity word list reloaded", "event", "profanity_reload", "source", source, "words", count)
+	return count, nil
+}
+
+// Reload the blocked word list without a restart (admins only)
+func reloadProfanity(c *gin.Context) {
+	claims, err := authenticate(c.Request)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+	if !claims.IsAdmin() {
+		respondError(c, http.StatusForbidden, codeForbidden, "Admin role required")
+		return
+	}
+	if profanityMode == "off" {
+		respondError(c, http.StatusConflict, codeInvalidRequest, "Profanity filter is disabled")
+		return
+	}
+
+	count, err := reloadProfanityWords("admin")
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, codeInternal, "Could not load word list")
+		return
+	}
+	respond(c, http.StatusOK, gin.H{"mode": profanityMode, "words": count})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// Swap in a filter mode and word list for one test
+func setProfanity(t *testing.T, mode string, words string) {
+	t.Helper()
+	// Registered before Setenv so it reloads after the variable is restored
+	previous := profanityMode
+	t.Cleanup(func() {
+		profanityMode = previous
+		loadProfanityWords()
+	})
+	t.Setenv("PROFANITY_WORDS", words)
+	profanityMode = mode
+	if _, err := loadProfanityWords(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilterProfanityMask(t *testing.T) {
+	setProfanity(t, "mask", "darn,блин,heck")
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"darn it", "**** it"},
+		{"DARN", "****"},
+		{"darn darn", "**** ****"},
+		{"darn,darn.", "****,****."},
+		{"darning needles", "darning needles"},
+		{"undarn", "undarn"},
+		{"darn_it", "darn_it"},
+		{"darn2", "darn2"},
+		{"ну блин!", "ну ****!"},
+		{"блинчики", "блинчики"},
+		{"éheck", "éheck"},
+		{"heck😀", "****😀"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got, err := filterProfanity(tt.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("filterProfanity(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterProfanityReject(t *testing.T) {
+	setProfanity(t, "reject", "darn")
+
+	if _, err := filterProfanity("oh darn"); err != errBlockedWords {
+		t.Errorf("error = %v, want errBlockedWords", err)
+	}
+	if _, err := filterProfanity("darning"); err != nil {
+		t.Errorf("error = %v for a longer word", err)
+	}
+}
+
+func TestProfanityFilteredOnce(t *testing.T) {
+	setProfanity(t, "mask", "darn")
+	store := newFakeStore()
+	store.addChat(Chat{ChatID: "c1", UserEmail: "user@example.com"})
+
+	msg, err := validateNewMessage("c1", ChatMessage{Sender: "user@example.com", Message: "darn"})
+	if err != nil || msg.Message != "****" {
+		t.Fatalf("validateNewMessage = %q, %v; want masked text", msg.Message, err)
+	}
+
+	// System notices are stored as written
+	notice, err := saveMessage(context.Background(), store, "c1", ChatMessage{Sender: "System", SenderRole: roleSystem, Message: "darn"})
+	if err != nil || notice.Message != "darn" {
+		t.Errorf("saveMessage = %q, %v; want the notice unfiltered", notice.Message, err)
+	}
+
+	if text, err := validateEdit("darn it"); err != nil || text != "**** it" {
+		t.Errorf("validateEdit = %q, %v; want masked text", text, err)
+	}
+}
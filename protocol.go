@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket subprotocols, newest first so it wins when a client offers both.
+// A client that sends no Sec-WebSocket-Protocol header speaks chat.v1.
+//
+// chat.v1: chat messages are sent as bare ChatMessage objects without a type.
+// chat.v2: every outbound frame has a type; chat messages arrive as
+// {"type":"message","message":{...}}, like edits and deletions.
+const (
+	protocolV1 = "chat.v1"
+	protocolV2 = "chat.v2"
+)
+
+var supportedProtocols = []string{protocolV2, protocolV1}
+
+var errUnsupportedProtocol = errors.New("unsupported WebSocket protocol")
+
+// Whether the upgrade request only offers protocols we don't speak
+func unsupportedProtocol(r *http.Request) bool {
+	requested := websocket.Subprotocols(r)
+	if len(requested) == 0 {
+		return false
+	}
+	for _, protocol := range requested {
+		if slices.Contains(supportedProtocols, protocol) {
+			return false
+		}
+	}
+	return true
+}
+
+// Protocol negotiated on an upgraded connection
+func negotiatedProtocol(ws *websocket.Conn) string {
+	if protocol := ws.Subprotocol(); protocol != "" {
+		return protocol
+	}
+	return protocolV1
+}
+
+// Shape a queued payload for the client's protocol version
+func (client *Client) frame(payload interface{}) interface{} {
+	if client.protocol == protocolV2 {
+		if msg, ok := payload.(ChatMessage); ok {
+			return MessageEvent{Type: "message", Message: msg}
+		}
+	}
+	return payload
+}
+
+// Payloads larger than WS_FRAGMENT_SIZE bytes (0 disables) are sent as one
+// WebSocket message split across several frames of at most that size, so a
+// big batch or admin feed event never needs a single giant frame. Clients get
+// the reassembled message from any standard WebSocket API, browsers included;
+// those reading raw frames must concatenate continuation frames until FIN
+// before parsing the JSON.
+var wsFragmentSize = getEnvInt("WS_FRAGMENT_SIZE", 64<<10)
+
+// WS_WRITE_BUFFER_SIZE, capped at the fragment size: the writer also ends a
+// frame whenever its buffer fills, so a bigger buffer would merge fragments.
+func wsWriteBufferSize() int {
+	size := getEnvInt("WS_WRITE_BUFFER_SIZE", 4096)
+	if wsFragmentSize > 0 {
+		return min(size, wsFragmentSize)
+	}
+	return size
+}
+
+// With WS_COMPRESSION on, only payloads of at least WS_COMPRESSION_THRESHOLD
+// bytes are compressed; small frames cost more CPU than they save.
+var wsCompressionThreshold = getEnvInt("WS_COMPRESSION_THRESHOLD", 512)
+
+// Write one queued payload as a text message, fragmenting it when it is large
+func (client *Client) writePayload(payload interface{}) error {
+	data, err := json.Marshal(client.frame(payload))
+	if err != nil {
+		return err
+	}
+	// Has no effect unless the client negotiated permessage-deflate
+	client.conn.EnableWriteCompression(len(data) >= wsCompressionThreshold)
+
+	if wsFragmentSize <= 0 || len(data) <= wsFragmentSize {
+		return client.conn.WriteMessage(websocket.TextMessage, data)
+	}
+	// Each chunk goes out as its own frame when it is over twice the write
+	// buffer; smaller ones are copied into the buffer, which is flushed as a
+	// frame whenever it fills and is never larger than a fragment
+	w, err := client.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := min(wsFragmentSize, len(data))
+		if _, err := w.Write(data[:n]); err != nil {
+			w.Close()
+			return err
+		}
+		data = data[n:]
+	}
+	return w.Close()
+}
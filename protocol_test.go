@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// Read the raw frames of one server message and return their payload sizes
+func readFrameSizes(t *testing.T, r io.Reader) []int {
+	t.Helper()
+	var sizes []int
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(r, header); err != nil {
+			t.Fatalf("reading frame header: %v", err)
+		}
+		size := uint64(header[1] & 0x7f)
+		switch size {
+		case 126:
+			ext := make([]byte, 2)
+			io.ReadFull(r, ext)
+			size = uint64(binary.BigEndian.Uint16(ext))
+		case 127:
+			ext := make([]byte, 8)
+			io.ReadFull(r, ext)
+			size = binary.BigEndian.Uint64(ext)
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+			t.Fatalf("reading frame payload: %v", err)
+		}
+		sizes = append(sizes, int(size))
+		if header[0]&0x80 != 0 { // FIN
+			return sizes
+		}
+	}
+}
+
+func TestWritePayloadFragments(t *testing.T) {
+	defer func(size int) { wsFragmentSize = size }(wsFragmentSize)
+
+	tests := []struct {
+		name            string
+		fragmentSize    int
+		writeBufferSize int
+		textSize        int
+		wantBuffer      int // Pooled write buffer size
+		wantFrame       int // Size of every frame but the last
+	}{
+		{"fragments larger than the write buffer", 20000, 4096, 50000, 4096, 20000},
+		{"write buffer larger than a fragment", 3000, 65536, 10000, 3000, 3000},
+		{"write buffer over half a fragment", 3000, 2000, 10000, 2000, 2000},
+		{"fits in one frame", 3000, 4096, 1000, 3000, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wsFragmentSize = tt.fragmentSize
+			t.Setenv("WS_WRITE_BUFFER_SIZE", strconv.Itoa(tt.writeBufferSize))
+			if got := wsWriteBufferSize(); got != tt.wantBuffer {
+				t.Errorf("wsWriteBufferSize() = %d, want %d", got, tt.wantBuffer)
+			}
+			upgrader := websocket.Upgrader{WriteBufferSize: wsWriteBufferSize(), WriteBufferPool: &sync.Pool{}}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ws, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer ws.Close()
+				// Wait for the client, so nothing is written during the handshake
+				if _, _, err := ws.ReadMessage(); err != nil {
+					return
+				}
+				client := &Client{conn: ws, protocol: protocolV1}
+				if err := client.writePayload(ErrorEvent{Type: "error", Error: strings.Repeat("x", tt.textSize)}); err != nil {
+					t.Errorf("writePayload: %v", err)
+				}
+			}))
+			defer server.Close()
+
+			ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ws.Close()
+			ws.WriteMessage(websocket.TextMessage, []byte("go"))
+
+			sizes := readFrameSizes(t, ws.UnderlyingConn())
+			if last := len(sizes) - 1; last > 0 && sizes[last] == 0 {
+				sizes = sizes[:last] // Close may end the message with an empty frame
+			}
+			total := 0
+			for i, size := range sizes {
+				total += size
+				if size > tt.fragmentSize {
+					t.Errorf("frame %d has %d bytes, over the %d byte fragment size", i, size, tt.fragmentSize)
+				}
+				if i < len(sizes)-1 && size != tt.wantFrame {
+					t.Errorf("frame %d has %d bytes, want %d byte frames before the last", i, size, tt.wantFrame)
+				}
+			}
+			if total < tt.textSize {
+				t.Errorf("frames carry %d bytes, want at least %d", total, tt.textSize)
+			}
+		})
+	}
+}
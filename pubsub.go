@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// With REDIS_URL set, every message and chat event is also published to the
+// Redis channel chat:<chatId>, and admin feed events and disconnects to
+// chat-control. Each instance relays what the others publish to its own
+// clients, so participants connected to different replicas reach each other.
+// Presence counts stay per instance. Without it delivery stays in memory,
+// which only works with one instance.
+var (
+	redisURL     = getEnv("REDIS_URL", "")
+	redisTimeout = getEnvDuration("REDIS_TIMEOUT", 2*time.Second)
+)
+
+const (
+	chatChannelPrefix = "chat:"
+	controlChannel    = "chat-control"
+
+	// Publications waiting for Redis. A full queue drops new ones instead of
+	// holding up the connection that produced them.
+	publishQueueSize = 1024
+)
+
+// What a publication asks the other instances to do
+const (
+	relayMessage    = ""           // Deliver Message to the chat and the admin feeds
+	relayChatEvent  = "chatEvent"  // Send Event to the chat's clients
+	relayAdminEvent = "adminEvent" // Send Event to the admin feeds
+	relayConnection = "connection" // Send Event to connection ConnectionID
+	relayCloseChat  = "closeChat"  // Close the chat's connections
+	relayDisconnect = "disconnect" // Close ConnectionID, or every connection of UserEmail
+)
+
+// Tells this instance's own publications apart from the other replicas'
+var instanceID = uuid.New().String()
+
+// Publications for the Redis publisher; nil while running in memory only
+var publishQueue chan chatPublication
+
+// chatPublication is a message or event relayed between instances
+type chatPublication struct {
+	Instance string      `json:"instance"`
+	Kind     string      `json:"kind,omitempty"`
+	ChatID   string      `json:"chatId,omitempty"`
+	Message  ChatMessage `json:"message"`
+
+	Event        json.RawMessage `json:"event,omitempty"`
+	ConnectionID string          `json:"connectionId,omitempty"`
+	UserEmail    string          `json:"userEmail,omitempty"`
+	CloseCode    int             `json:"closeCode,omitempty"`
+	CloseReason  string          `json:"closeReason,omitempty"`
+}
+
+// Connect to Redis and relay other instances' messages until ctx is cancelled.
+// Does nothing when REDIS_URL is unset.
+func startPubSub(ctx context.Context) error {
+	if redisURL == "" {
+		slog.Info("Redis pub/sub disabled, delivering in memory only", "event", "pubsub")
+		return nil
+	}
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return err
+	}
+	client := redis.NewClient(opts)
+
+	pingCtx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	if err := client.Ping(pingCtx).Err(); err != nil {
+		client.Close()
+		return err
+	}
+
+	// Subscribe before publishing so no message from this instance's start is missed
+	sub := client.PSubscribe(ctx, chatChannelPrefix+"*", controlChannel)
+	if _, err := sub.Receive(pingCtx); err != nil {
+		client.Close()
+		return err
+	}
+	publishQueue = make(chan chatPublication, publishQueueSize)
+	slog.Info("Redis pub/sub enabled", "event", "pubsub", "instance", instanceID)
+
+	go relayPublications(ctx, sub)
+	go runPublisher(ctx, client, publishQueue)
+	return nil
+}
+
+// Deliver what other instances publish to the local clients.
+// The subscription reconnects on its own after Redis outages.
+func relayPublications(ctx context.Context, sub *redis.PubSub) {
+	defer sub.Close()
+	channel := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case received, ok := <-channel:
+			if !ok {
+				return
+			}
+			var publication chatPublication
+			if err := json.Unmarshal([]byte(received.Payload), &publication); err != nil {
+				slog.Warn("Invalid chat publication", "event", "pubsub", "channel", received.Channel, "error", err)
+				continue
+			}
+			if publication.Instance == instanceID {
+				continue // Already delivered locally
+			}
+			applyPublication(publication)
+		}
+	}
+}
+
+// Carry out another instance's publication on this one's clients
+func applyPublication(p chatPublication) {
+	switch p.Kind {
+	case relayMessage:
+		deliverMessage(p.ChatID, p.Message)
+	case relayChatEvent:
+		registry.BroadcastTo(p.ChatID, p.Event, nil)
+	case relayAdminEvent:
+		registry.BroadcastAdmins(p.Event)
+	case relayConnection:
+		registry.SendToConnection(p.ConnectionID, p.Event)
+	case relayCloseChat:
+		registry.CloseChat(p.ChatID)
+	case relayDisconnect:
+		if p.ConnectionID != "" {
+			registry.DisconnectConnection(p.ConnectionID, p.CloseCode, p.CloseReason)
+		} else {
+			registry.DisconnectUser(p.UserEmail, p.CloseCode, p.CloseReason)
+		}
+	default:
+		slog.Warn("Unknown chat publication", "event", "pubsub", "kind", p.Kind)
+	}
+}
+
+// Publish queued publications in order until ctx is cancelled
+func runPublisher(ctx context.Context, client *redis.Client, queue <-chan chatPublication) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case publication := <-queue:
+			payload, err := json.Marshal(publication)
+			if err != nil {
+				slog.Error("Error encoding chat publication", "event", "pubsub", "kind", publication.Kind, "chatId", publication.ChatID, "error", err)
+				continue
+			}
+			channel := controlChannel
+			if publication.ChatID != "" {
+				channel = chatChannelPrefix + publication.ChatID
+			}
+
+			publishCtx, cancel := context.WithTimeout(ctx, redisTimeout)
+			err = client.Publish(publishCtx, channel, payload).Err()
+			cancel()
+			if err != nil {
+				slog.Error("Error publishing to other instances", "event", "pubsub", "kind", publication.Kind, "chatId", publication.ChatID, "msgId", publication.Message.MsgID, "error", err)
+			}
+		}
+	}
+}
+
+// Queue a publication for the other instances without blocking; failures
+// only cost cross-instance delivery
+func publish(publication chatPublication) {
+	if publishQueue == nil {
+		return
+	}
+	publication.Instance = instanceID
+	select {
+	case publishQueue <- publication:
+	default:
+		slog.Warn("Publish queue full, dropping publication", "event", "pubsub", "kind", publication.Kind, "chatId", publication.ChatID)
+	}
+}
+
+// Publish an event payload; events that can't be encoded stay local
+func publishEvent(publication chatPublication, event interface{}) {
+	if publishQueue == nil {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Error encoding chat publication", "event", "pubsub", "kind", publication.Kind, "chatId", publication.ChatID, "error", err)
+		return
+	}
+	publication.Event = data
+	publish(publication)
+}
+
+// Publish a message for the other instances
+func publishMessage(chatID string, msg ChatMessage) {
+	publish(chatPublication{ChatID: chatID, Message: msg})
+}
+
+// Send an event to a chat's clients on every instance, except the given local client
+func broadcastEvent(chatID string, event interface{}, except *Client) {
+	registry.BroadcastTo(chatID, event, except)
+	publishEvent(chatPublication{Kind: relayChatEvent, ChatID: chatID}, event)
+}
+
+// Send an event to the admin feeds on every instance
+func broadcastAdminEvent(event interface{}) {
+	registry.BroadcastAdmins(event)
+	publishEvent(chatPublication{Kind: relayAdminEvent}, event)
+}
+
+// Send an event to a connection, whichever instance holds it
+func sendToConnection(id string, event interface{}) {
+	if !registry.SendToConnection(id, event) {
+		publishEvent(chatPublication{Kind: relayConnection, ConnectionID: id}, event)
+	}
+}
+
+// Close a chat's connections on every instance
+func closeChatConnections(chatID string) {
+	registry.CloseChat(chatID)
+	publish(chatPublication{Kind: relayCloseChat, ChatID: chatID})
+}
+
+// Close a connection, whichever instance holds it. Only reports it when it
+// was open on this instance.
+func disconnectConnection(id string, code int, reason string) (ConnectionInfo, bool) {
+	info, ok := registry.DisconnectConnection(id, code, reason)
+	if !ok {
+		publish(chatPublication{Kind: relayDisconnect, ConnectionID: id, CloseCode: code, CloseReason: reason})
+	}
+	return info, ok
+}
+
+// Close every connection of a user on every instance; returns the ones open
+// on this instance
+func disconnectUser(userEmail string, code int, reason string) []ConnectionInfo {
+	closed := registry.DisconnectUser(userEmail, code, reason)
+	publish(chatPublication{Kind: relayDisconnect, UserEmail: userEmail, CloseCode: code, CloseReason: reason})
+	return closed
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// Route publications into a queue the test reads instead of Redis
+func usePublishQueue(t *testing.T, size int) chan chatPublication {
+	t.Helper()
+	saved := publishQueue
+	publishQueue = make(chan chatPublication, size)
+	t.Cleanup(func() { publishQueue = saved })
+	return publishQueue
+}
+
+func TestPublishDoesNotBlock(t *testing.T) {
+	queue := usePublishQueue(t, 1)
+
+	done := make(chan struct{})
+	go func() {
+		publishMessage("c1", ChatMessage{MsgID: "m1"})
+		publishMessage("c1", ChatMessage{MsgID: "m2"}) // Queue is full, dropped
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing blocked on a full queue")
+	}
+	if got := <-queue; got.Message.MsgID != "m1" || got.Instance != instanceID {
+		t.Errorf("queued %+v, want m1 from this instance", got)
+	}
+}
+
+func TestBroadcastEventPublishes(t *testing.T) {
+	useTestRegistry(t)
+	queue := usePublishQueue(t, 10)
+	sender := addTestClient(t, "conn-1", "c1", "user@example.com", time.Now())
+	other := addTestClient(t, "conn-2", "c1", "agent@example.com", time.Now())
+
+	broadcastEvent("c1", TypingEvent{Type: "typing", Sender: "user@example.com", IsTyping: true}, sender)
+
+	if len(sender.send) != 0 || len(other.send) != 1 {
+		t.Errorf("queued %d frames for the sender and %d for the other client, want 0 and 1", len(sender.send), len(other.send))
+	}
+	got := <-queue
+	var event TypingEvent
+	if err := json.Unmarshal(got.Event, &event); err != nil || got.Kind != relayChatEvent || got.ChatID != "c1" || event.Sender != "user@example.com" {
+		t.Errorf("published %+v", got)
+	}
+}
+
+func TestApplyPublication(t *testing.T) {
+	typing, _ := json.Marshal(TypingEvent{Type: "typing", Sender: "agent@example.com"})
+
+	tests := []struct {
+		name        string
+		publication chatPublication
+		wantFrames  int // Queued for conn-1
+		wantClose   int // conn-1's close code, 0 while open
+	}{
+		{"message", chatPublication{ChatID: "c1", Message: ChatMessage{MsgID: "m1"}}, 1, 0},
+		{"chat event", chatPublication{Kind: relayChatEvent, ChatID: "c1", Event: typing}, 1, 0},
+		{"event for another chat", chatPublication{Kind: relayChatEvent, ChatID: "c2", Event: typing}, 0, 0},
+		{"connection event", chatPublication{Kind: relayConnection, ConnectionID: "conn-1", Event: typing}, 1, 0},
+		{"chat closed", chatPublication{Kind: relayCloseChat, ChatID: "c1"}, 0, closeChatEnded},
+		{"user banned", chatPublication{Kind: relayDisconnect, UserEmail: "user@example.com", CloseCode: closeBanned}, 0, closeBanned},
+		{"connection kicked", chatPublication{Kind: relayDisconnect, ConnectionID: "conn-1", CloseCode: closeKicked}, 0, closeKicked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestRegistry(t)
+			client := addTestClient(t, "conn-1", "c1", "user@example.com", time.Now())
+
+			applyPublication(tt.publication)
+
+			if tt.wantClose != 0 {
+				if client.closeCode != tt.wantClose {
+					t.Errorf("close code = %d, want %d", client.closeCode, tt.wantClose)
+				}
+				return
+			}
+			if len(client.send) != tt.wantFrames {
+				t.Errorf("queued %d frames, want %d", len(client.send), tt.wantFrames)
+			}
+		})
+	}
+}
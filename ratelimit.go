@@ -0,0 +1,41 @@
+package main
+
+import "time"
+
+// Per-connection rate limit for inbound frames
+var (
+	rateLimitPerSecond     = getEnvFloat("RATE_LIMIT_PER_SECOND", 5)
+	rateLimitBurst         = getEnvInt("RATE_LIMIT_BURST", 10)
+	rateLimitMaxViolations = getEnvInt("RATE_LIMIT_MAX_VIOLATIONS", 10) // Close the connection after this many dropped frames
+)
+
+// tokenBucket refills at rate tokens per second up to burst.
+// It is owned by a single read loop and is not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Take a token if one is available
+func (b *tokenBucket) Allow() bool {
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
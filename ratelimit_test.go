@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(2, 3)
+
+	for i := 0; i < 3; i++ {
+		if !bucket.Allow() {
+			t.Fatalf("frame %d of the burst was throttled", i+1)
+		}
+	}
+	if bucket.Allow() {
+		t.Fatal("frame past the burst was allowed")
+	}
+
+	// Half a second at 2 per second refills one token
+	bucket.last = bucket.last.Add(-500 * time.Millisecond)
+	if !bucket.Allow() {
+		t.Error("refilled token was not available")
+	}
+	if bucket.Allow() {
+		t.Error("allowed more than the refill")
+	}
+
+	// A long pause refills no more than the burst
+	bucket.last = bucket.last.Add(-time.Hour)
+	allowed := 0
+	for bucket.Allow() {
+		allowed++
+	}
+	if allowed != 3 {
+		t.Errorf("allowed %d frames after a long pause, want the burst of 3", allowed)
+	}
+}
+
+func TestFloodingClientIsThrottledThenClosed(t *testing.T) {
+	defer func(rate float64, burst, violations int) {
+		rateLimitPerSecond, rateLimitBurst, rateLimitMaxViolations = rate, burst, violations
+	}(rateLimitPerSecond, rateLimitBurst, rateLimitMaxViolations)
+	rateLimitPerSecond, rateLimitBurst, rateLimitMaxViolations = 0.001, 3, 2
+
+	store := newFakeStore()
+	store.addChat(Chat{ChatID: testChatID, UserEmail: "user@example.com"})
+	ws := dialChat(t, startWS(t, store), Claims{Email: "user@example.com"}, map[string]string{"chatId": testChatID})
+	readFrame(t, ws, "init")
+
+	for i := 0; i < 10; i++ {
+		ws.WriteJSON(map[string]interface{}{"type": "typing", "isTyping": true})
+	}
+	if err := readFrame(t, ws, "error"); err["error"] != "Rate limit exceeded, frame dropped" {
+		t.Errorf("error frame = %v", err)
+	}
+	if code := readCloseCode(t, ws); code != closeRateLimited {
+		t.Errorf("close code = %d, want %d", code, closeRateLimited)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// clientRegistry tracks the live WebSocket clients by connection ID, with
+// indexes by chat and by user. Every read or change goes through its methods,
+// which hold mu, so a client is removed and its send channel closed exactly
+// once no matter which path gets there first.
+type clientRegistry struct {
+	mu      sync.Mutex
+	clients map[string]*Client            // By connection ID
+	byChat  map[string]map[string]*Client // Chat ID -> connection ID -> client; the admin feed isn't in a chat
+	byUser  map[string]map[string]*Client // Email -> connection ID -> client
+}
+
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{
+		clients: make(map[string]*Client),
+		byChat:  make(map[string]map[string]*Client),
+		byUser:  make(map[string]map[string]*Client),
+	}
+}
+
+// Active WebSocket connections
+var registry = newClientRegistry()
+
+// ConnectionInfo describes a live connection
+type ConnectionInfo struct {
+	ID          string    `json:"connectionId"`
+	ChatID      string    `json:"chatId,omitempty"`
+	Email       string    `json:"userEmail"`
+	Role        string    `json:"role"`
+	AllChats    bool      `json:"allChats,omitempty"`
+	ConnectedAt time.Time `json:"connectedAt"`
+}
+
+func (client *Client) info() ConnectionInfo {
+	return ConnectionInfo{
+		ID:          client.id,
+		ChatID:      client.chatID,
+		Email:       client.email,
+		Role:        client.role,
+		AllChats:    client.allChats,
+		ConnectedAt: client.connectedAt,
+	}
+}
+
+// Register a client so it receives broadcasts, unless a connection cap is reached.
+// The client must have a unique connection ID.
+func (r *clientRegistry) Add(client *Client) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.checkLimitsLocked(client.email); err != nil {
+		return err
+	}
+	if client.connectedAt.IsZero() {
+		client.connectedAt = time.Now().UTC()
+	}
+	r.clients[client.id] = client
+	if !client.allChats {
+		addToIndex(r.byChat, client.chatID, client)
+	}
+	addToIndex(r.byUser, client.email, client)
+	return nil
+}
+
+func addToIndex(index map[string]map[string]*Client, key string, client *Client) {
+	if index[key] == nil {
+		index[key] = make(map[string]*Client)
+	}
+	index[key][client.id] = client
+}
+
+func removeFromIndex(index map[string]map[string]*Client, key string, client *Client) {
+	delete(index[key], client.id)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
+
+// Remove a client and stop its writer. Safe to call more than once.
+func (r *clientRegistry) Remove(client *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removeLocked(client)
+}
+
+func (r *clientRegistry) removeLocked(client *Client) {
+	if r.clients[client.id] != client {
+		return
+	}
+	delete(r.clients, client.id)
+	if !client.allChats {
+		removeFromIndex(r.byChat, client.chatID, client)
+	}
+	removeFromIndex(r.byUser, client.email, client)
+	close(client.send)
+}
+
+// Remove a client and have its writer close the socket with the given code
+func (r *clientRegistry) Disconnect(client *Client, code int, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.disconnectLocked(client, code, reason)
+}
+
+// The writer reads the close code after the send channel is closed
+func (r *clientRegistry) disconnectLocked(client *Client, code int, reason string) {
+	if r.clients[client.id] == client {
+		client.closeCode = code
+		client.closeReason = reason
+		r.removeLocked(client)
+	}
+}
+
+// Disconnect the connection with the given ID; reports whether it was open
+func (r *clientRegistry) DisconnectConnection(id string, code int, reason string) (ConnectionInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	client, ok := r.clients[id]
+	if !ok {
+		return ConnectionInfo{}, false
+	}
+	r.disconnectLocked(client, code, reason)
+	return client.info(), true
+}
+
+// Remove every client of a chat; their writers flush what is queued and close
+// the sockets with closeChatEnded
+func (r *clientRegistry) CloseChat(chatID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, client := range r.byChat[chatID] {
+		r.disconnectLocked(client, closeChatEnded, "chat ended")
+	}
+}
+
+// Disconnect every connection of a user with the given code; returns the
+// connections that were open, oldest first
+func (r *clientRegistry) DisconnectUser(userEmail string, code int, reason string) []ConnectionInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	infos := connectionInfos(r.byUser[userEmail])
+	for _, client := range r.byUser[userEmail] {
+		r.disconnectLocked(client, code, reason)
+	}
+	return infos
+}
+
+// Queue a payload for a single client
+func (r *clientRegistry) Send(client *Client, payload interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enqueueLocked(client, payload)
+}
+
+// Queue a payload for the connection with the given ID, if it is still open;
+// reports whether it was
+func (r *clientRegistry) SendToConnection(id string, payload interface{}) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client, ok := r.clients[id]
+	if ok {
+		r.enqueueLocked(client, payload)
+	}
+	return ok
+}
+
+// Queue any JSON payload for the clients of a chat, skipping the except connection.
+// Never blocks on a slow client.
+func (r *clientRegistry) BroadcastTo(chatID string, payload interface{}, except *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, client := range r.byChat[chatID] {
+		if client != except {
+			r.enqueueLocked(client, payload)
+		}
+	}
+}
+
+// Queue a payload for every admin on the all-chats feed
+func (r *clientRegistry) BroadcastAdmins(payload interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, client := range r.clients {
+		if client.allChats {
+			r.enqueueLocked(client, payload)
+		}
+	}
+}
+
+// Queue a payload without blocking; a client whose queue is full is dropped
+func (r *clientRegistry) enqueueLocked(client *Client, payload interface{}) {
+	if r.clients[client.id] != client {
+		return
+	}
+	select {
+	case client.send <- payload:
+	default:
+		slog.Warn("WebSocket client too slow, dropping connection", "event", "ws_slow_client", "chatId", client.chatID, "userEmail", client.email)
+		r.disconnectLocked(client, websocket.ClosePolicyViolation, "too slow")
+	}
+}
+
+// Number of open connections
+func (r *clientRegistry) Count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.clients)
+}
+
+// Live connections of a chat, oldest first
+func (r *clientRegistry) ChatConnections(chatID string) []ConnectionInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return connectionInfos(r.byChat[chatID])
+}
+
+func connectionInfos(clients map[string]*Client) []ConnectionInfo {
+	infos := make([]ConnectionInfo, 0, len(clients))
+	for _, client := range clients {
+		infos = append(infos, client.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+	})
+	return infos
+}
+
+// Count live connections of a chat and the distinct users behind them
+func (r *clientRegistry) Presence(chatID string) (int, []string) {
+	connections := r.ChatConnections(chatID)
+	seen := make(map[string]bool)
+	users := []string{}
+	for _, conn := range connections {
+		if !seen[conn.Email] {
+			seen[conn.Email] = true
+			users = append(users, conn.Email)
+		}
+	}
+	sort.Strings(users)
+	return len(connections), users
+}
+
+// Number of admin sockets joined to a chat; the all-chats feed doesn't count
+func (r *clientRegistry) AdminCount(chatID string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	count := 0
+	for _, client := range r.byChat[chatID] {
+		if client.role == roleAdmin {
+			count++
+		}
+	}
+	return count
+}
+
+// Whether one more connection for the user fits under both connection caps
+func (r *clientRegistry) CheckLimits(userEmail string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.checkLimitsLocked(userEmail)
+}
+
+// Counts come from the registry itself, so every removal frees its slot
+func (r *clientRegistry) checkLimitsLocked(userEmail string) error {
+	if maxConnections > 0 && len(r.clients) >= maxConnections {
+		return errServerFull
+	}
+	if maxConnectionsPerUser > 0 && len(r.byUser[userEmail]) >= maxConnectionsPerUser {
+		return errUserConnectionCap
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Swap in an empty registry for the test
+func useTestRegistry(t *testing.T) {
+	t.Helper()
+	saved := registry
+	registry = newClientRegistry()
+	t.Cleanup(func() { registry = saved })
+}
+
+func addTestClient(t *testing.T, id, chatID, email string, connectedAt time.Time) *Client {
+	t.Helper()
+	client := &Client{id: id, chatID: chatID, email: email, role: roleCustomer, send: make(chan interface{}, sendBufferSize), connectedAt: connectedAt}
+	if err := registry.Add(client); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestChatPresenceConnectionDetails(t *testing.T) {
+	useTestRegistry(t)
+	base := time.Now().UTC()
+	addTestClient(t, "conn-2", "c1", "user@example.com", base.Add(time.Second))
+	addTestClient(t, "conn-1", "c1", "user@example.com", base)
+	addTestClient(t, "conn-3", "c2", "other@example.com", base)
+
+	tests := []struct {
+		name        string
+		token       string
+		wantDetails string
+	}{
+		{"anonymous", "", ""},
+		{"customer", testToken(t, Claims{Email: "user@example.com"}), ""},
+		{"admin", testToken(t, Claims{Email: "agent@example.com", Role: roleAdmin}), "conn-1,conn-2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(http.MethodGet, "/chat/:chatId/presence", "/chat/c1/presence", nil, tt.token, getChatPresence)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+			}
+			var got struct {
+				Connections       int              `json:"connections"`
+				Users             []string         `json:"users"`
+				ConnectionDetails []ConnectionInfo `json:"connectionDetails"`
+			}
+			decodeEnvelope(t, w, &got)
+			if got.Connections != 2 || strings.Join(got.Users, ",") != "user@example.com" {
+				t.Errorf("presence = %d connections of %v", got.Connections, got.Users)
+			}
+			var ids []string
+			for _, conn := range got.ConnectionDetails {
+				ids = append(ids, conn.ID)
+			}
+			if strings.Join(ids, ",") != tt.wantDetails {
+				t.Errorf("connection details = %v, want %s", ids, tt.wantDetails)
+			}
+		})
+	}
+}
+
+func TestForceDisconnect(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantClosed string
+	}{
+		{"one connection", `{"connectionId":"conn-1"}`, "conn-1"},
+		{"every connection of a user", `{"userEmail":"user@example.com"}`, "conn-1,conn-2"},
+		{"unknown connection", `{"connectionId":"conn-9"}`, ""},
+	}
+
+	token := testToken(t, Claims{Email: "agent@example.com", Role: roleAdmin})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestRegistry(t)
+			base := time.Now().UTC()
+			clients := []*Client{
+				addTestClient(t, "conn-1", "c1", "user@example.com", base),
+				addTestClient(t, "conn-2", "c1", "user@example.com", base.Add(time.Second)),
+				addTestClient(t, "conn-3", "c2", "other@example.com", base),
+			}
+
+			w := serve(http.MethodPost, "/admin/disconnect", "/admin/disconnect", strings.NewReader(tt.body), token, forceDisconnect)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+			}
+			var got struct {
+				Disconnected int              `json:"disconnected"`
+				Connections  []ConnectionInfo `json:"connections"`
+			}
+			decodeEnvelope(t, w, &got)
+			var ids []string
+			for _, conn := range got.Connections {
+				ids = append(ids, conn.ID)
+			}
+			if strings.Join(ids, ",") != tt.wantClosed || got.Disconnected != len(ids) {
+				t.Errorf("disconnected %d: %v, want %s", got.Disconnected, ids, tt.wantClosed)
+			}
+			for _, client := range clients {
+				if closed := client.closeCode == closeKicked; closed != strings.Contains(tt.wantClosed, client.id) {
+					t.Errorf("%s close code = %d", client.id, client.closeCode)
+				}
+			}
+		})
+	}
+}
+
+// Run with -race: clients join, broadcast, leave and get kicked at once
+func TestRegistryConcurrentUse(t *testing.T) {
+	useTestRegistry(t)
+	const workers = 50
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			chatID := fmt.Sprintf("c%d", i%5)
+			client := &Client{id: fmt.Sprintf("conn-%d", i), chatID: chatID, email: fmt.Sprintf("user%d@example.com", i%10), send: make(chan interface{}, sendBufferSize)}
+			if err := registry.Add(client); err != nil {
+				t.Error(err)
+				return
+			}
+			// Drain like a writer until the registry closes the queue
+			drained := make(chan struct{})
+			go func() {
+				for range client.send {
+				}
+				close(drained)
+			}()
+
+			registry.BroadcastTo(chatID, TypingEvent{Type: "typing"}, client)
+			registry.BroadcastAdmins(TypingEvent{Type: "typing"})
+			registry.Presence(chatID)
+			registry.ChatConnections(chatID)
+			switch i % 4 {
+			case 0:
+				registry.Remove(client)
+			case 1:
+				registry.DisconnectConnection(client.id, closeKicked, "kicked")
+			case 2:
+				registry.DisconnectUser(client.email, closeBanned, "banned")
+			case 3:
+				registry.CloseChat(chatID)
+			}
+			// Removing twice must not close the queue twice
+			registry.Remove(client)
+			<-drained
+		}(i)
+	}
+	wg.Wait()
+
+	if n := registry.Count(); n != 0 {
+		t.Errorf("%d connections left in the registry", n)
+	}
+}
+
+func TestRegistryUserCapUnderConcurrentAdds(t *testing.T) {
+	useTestRegistry(t)
+	defer func(limit int) { maxConnectionsPerUser = limit }(maxConnectionsPerUser)
+	maxConnectionsPerUser = 3
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	added := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client := &Client{id: fmt.Sprintf("conn-%d", i), chatID: "c1", email: "user@example.com", send: make(chan interface{}, 1)}
+			if registry.Add(client) == nil {
+				mu.Lock()
+				added++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if added != maxConnectionsPerUser {
+		t.Errorf("added %d connections, want the cap of %d", added, maxConnectionsPerUser)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Envelope is the shape of every HTTP response: data on success, error otherwise
+type Envelope struct {
+	Data  interface{} `json:"data,omitempty"`
+	Error *APIError   `json:"error,omitempty"`
+}
+
+// APIError carries a stable code for clients to branch on and a readable message
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error codes
+const (
+	codeInvalidRequest      = "invalid_request"
+	codeInvalidChatID       = "invalid_chat_id"
+	codeUnauthorized        = "unauthorized"
+	codeForbidden           = "forbidden"
+	codeChatNotFound        = "chat_not_found"
+	codeMessageNotFound     = "message_not_found"
+	codeMessageArchived     = "message_archived"
+	codeChatClosed          = "chat_closed"
+	codeChatNotClosed       = "chat_not_closed"
+	codeChatAlreadyAssigned = "chat_already_assigned"
+	codeAssigneeMismatch    = "assignee_mismatch"
+	codeActiveChatExists    = "active_chat_exists"
+	codeFileTooLarge        = "file_too_large"
+	codeUnsupportedFileType = "unsupported_file_type"
+	codeUserNotBanned       = "user_not_banned"
+	codeBlockedWords        = "blocked_words"
+	codeMetadataConflict    = "metadata_conflict"
+	codeScheduledNotFound   = "scheduled_message_not_found"
+	codeDatabaseError       = "database_error"
+	codeDatabaseTimeout     = "database_timeout"
+	codeUnavailable         = "unavailable"
+	codeInternal            = "internal_error"
+)
+
+// Write a successful response
+func respond(c *gin.Context, status int, data interface{}) {
+	c.JSON(status, Envelope{Data: data})
+}
+
+// Write an error response
+func respondError(c *gin.Context, status int, code, message string) {
+	c.JSON(status, Envelope{Error: &APIError{Code: code, Message: message}})
+}
+
+// Write an error response and stop the handler chain
+func abortWithError(c *gin.Context, status int, code, message string) {
+	c.AbortWithStatusJSON(status, Envelope{Error: &APIError{Code: code, Message: message}})
+}
+
+// Write the response for a failed database call: 504 when it timed out, 500 otherwise
+func respondDBError(c *gin.Context, err error, message string) {
+	status := dbErrorStatus(err)
+	code := codeDatabaseError
+	if status == http.StatusGatewayTimeout {
+		code = codeDatabaseTimeout
+	}
+	respondError(c, status, code, message)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Ended chats older than CHAT_RETENTION_DAYS are purged every
+// RETENTION_SWEEP_INTERVAL. A retention of 0 (the default) keeps chats forever.
+var (
+	chatRetentionDays      = getEnvInt("CHAT_RETENTION_DAYS", 0)
+	retentionSweepInterval = getEnvDuration("RETENTION_SWEEP_INTERVAL", time.Hour)
+)
+
+// Periodically purge expired ended chats until ctx is cancelled
+func runRetention(ctx context.Context, store ChatStore) {
+	if chatRetentionDays <= 0 {
+		slog.Info("Chat retention disabled", "event", "retention")
+		return
+	}
+	slog.Info("Chat retention enabled", "event", "retention", "days", chatRetentionDays, "interval", retentionSweepInterval.String())
+
+	runSweeper(ctx, retentionSweepInterval, func(ctx context.Context) {
+		purgeExpiredChats(ctx, store)
+	})
+}
+
+// Delete ended chats closed before the retention cutoff. Chats ended before
+// closedAt was recorded fall back to their last activity.
+func purgeExpiredChats(parent context.Context, store ChatStore) {
+	cutoff := time.Now().AddDate(0, 0, -chatRetentionDays)
+
+	ctx, cancel := dbContext(parent)
+	defer cancel()
+
+	chatIDs, err := store.FindChatIDs(ctx, ChatIDQuery{Status: "ended", ClosedBefore: &cutoff})
+	if err != nil {
+		slog.Error("Error finding expired chats", "event", "retention", "error", err)
+		return
+	}
+	if len(chatIDs) == 0 {
+		slog.Info("Purged expired chats", "event", "retention", "deleted", 0, "cutoff", cutoff)
+		return
+	}
+
+	// A chat reopened since it was found has "active" status and is kept
+	deleted, err := store.DeleteChats(ctx, chatIDs, "ended")
+	if deleted > 0 && err != nil {
+		slog.Error("Error purging archived messages", "event", "retention", "error", err)
+	} else if err != nil {
+		slog.Error("Error purging expired chats", "event", "retention", "error", err)
+		return
+	}
+
+	// Keep the files of a chat that was reopened since it was found
+	gone := chatIDs
+	if deleted < int64(len(chatIDs)) {
+		gone = nil
+		for _, chatID := range chatIDs {
+			if _, err := store.GetChat(ctx, chatID); err == mongo.ErrNoDocuments {
+				gone = append(gone, chatID)
+			}
+		}
+	}
+	removeChatUploads(gone)
+	slog.Info("Purged expired chats", "event", "retention", "deleted", deleted, "cutoff", cutoff)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Create an upload directory with one file for each chat
+func makeUploads(t *testing.T, chatIDs ...string) {
+	t.Helper()
+	for _, chatID := range chatIDs {
+		dir := filepath.Join(uploadDir, chatID)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "file.png"), []byte("png"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func hasUploads(chatID string) bool {
+	_, err := os.Stat(filepath.Join(uploadDir, chatID))
+	return err == nil
+}
+
+func TestPurgeExpiredChatsRemovesUploads(t *testing.T) {
+	defer func(dir string, days int) { uploadDir, chatRetentionDays = dir, days }(uploadDir, chatRetentionDays)
+	uploadDir = t.TempDir()
+	chatRetentionDays = 30
+
+	store := newFakeStore()
+	old := time.Now().AddDate(0, 0, -60)
+	store.addChat(Chat{ChatID: "expired", UserEmail: "a@example.com", Status: "ended", ClosedAt: old})
+	store.addChat(Chat{ChatID: "recent", UserEmail: "b@example.com", Status: "ended", ClosedAt: time.Now()})
+	store.addChat(Chat{ChatID: "active", UserEmail: "c@example.com", LastMessageTime: old})
+	makeUploads(t, "expired", "recent", "active")
+
+	purgeExpiredChats(context.Background(), store)
+
+	for chatID, want := range map[string]bool{"expired": false, "recent": true, "active": true} {
+		if _, ok := store.chat(chatID); ok != want {
+			t.Errorf("chat %s kept = %v, want %v", chatID, ok, want)
+		}
+		if got := hasUploads(chatID); got != want {
+			t.Errorf("uploads of %s kept = %v, want %v", chatID, got, want)
+		}
+	}
+}
+
+func TestDeleteChatRemovesUploads(t *testing.T) {
+	defer func(dir string) { uploadDir = dir }(uploadDir)
+	uploadDir = t.TempDir()
+
+	store := newFakeStore()
+	store.addChat(Chat{ChatID: "c1", UserEmail: "user@example.com"})
+	store.addChat(Chat{ChatID: "c2", UserEmail: "other@example.com"})
+	makeUploads(t, "c1", "c2")
+	token := testToken(t, Claims{Email: "agent@example.com", Role: roleAdmin})
+
+	w := serve(http.MethodDelete, "/chat/:chatId", "/chat/c1", nil, token, deleteChat(store))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if hasUploads("c1") || !hasUploads("c2") {
+		t.Errorf("uploads kept: c1 %v, c2 %v; want only c2", hasUploads("c1"), hasUploads("c2"))
+	}
+}
+
+func TestDeleteUserChatsRemovesUploads(t *testing.T) {
+	defer func(dir string) { uploadDir = dir }(uploadDir)
+	uploadDir = t.TempDir()
+
+	store := newFakeStore()
+	store.addChat(Chat{ChatID: "c1", UserEmail: "user@example.com", Status: "ended"})
+	store.addChat(Chat{ChatID: "c2", UserEmail: "user@example.com"})
+	store.addChat(Chat{ChatID: "c3", UserEmail: "other@example.com"})
+	makeUploads(t, "c1", "c2", "c3")
+	token := testToken(t, Claims{Email: "user@example.com"})
+
+	w := serve(http.MethodDelete, "/user/:userEmail/chats", "/user/user@example.com/chats", nil, token, deleteUserChats(store))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if hasUploads("c1") || hasUploads("c2") || !hasUploads("c3") {
+		t.Errorf("uploads kept: c1 %v, c2 %v, c3 %v; want only c3", hasUploads("c1"), hasUploads("c2"), hasUploads("c3"))
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How often the scheduler looks for due messages
+var schedulePollInterval = getEnvDuration("SCHEDULE_POLL_INTERVAL", 10*time.Second)
+
+// Failed sends are retried SCHEDULE_MAX_ATTEMPTS times in all, waiting
+// SCHEDULE_RETRY_BACKOFF after the first failure and twice as long after each
+// next one. A message left in sending for SCHEDULE_CLAIM_LEASE, say by an
+// instance that crashed, is claimed again.
+var (
+	scheduleMaxAttempts  = getEnvInt("SCHEDULE_MAX_ATTEMPTS", 5)
+	scheduleRetryBackoff = getEnvDuration("SCHEDULE_RETRY_BACKOFF", 30*time.Second)
+	scheduleClaimLease   = getEnvDuration("SCHEDULE_CLAIM_LEASE", 5*time.Minute)
+)
+
+// Longest wait between two attempts
+const maxScheduleBackoff = time.Hour
+
+// Scheduled message states
+const (
+	scheduledPending  = "pending"
+	scheduledSending  = "sending"
+	scheduledSent     = "sent"
+	scheduledCanceled = "canceled"
+	scheduledSkipped  = "skipped" // The chat was closed before the send time
+	scheduledFailed   = "failed"  // Rejected by validation or out of attempts
+)
+
+// ScheduledMessage is a message an admin queued to be sent later
+type ScheduledMessage struct {
+	ID         string     `bson:"_id" json:"id"`
+	ChatID     string     `bson:"chatId" json:"chatId"`
+	Sender     string     `bson:"sender" json:"sender"`
+	SenderName string     `bson:"senderName" json:"senderName"`
+	Message    string     `bson:"message" json:"message"`
+	SendAt     time.Time  `bson:"sendAt" json:"sendAt"`
+	Status     string     `bson:"status" json:"status"`
+	CreatedAt  time.Time  `bson:"createdAt" json:"createdAt"`
+	SentAt     *time.Time `bson:"sentAt,omitempty" json:"sentAt,omitempty"`
+	MsgID      string     `bson:"msgId,omitempty" json:"msgId,omitempty"` // The message it became once sent
+
+	Attempts      int        `bson:"attempts,omitempty" json:"attempts,omitempty"`           // Times it was claimed for sending
+	NextAttemptAt *time.Time `bson:"nextAttemptAt,omitempty" json:"nextAttemptAt,omitempty"` // Retry time after a failed attempt
+	ClaimedAt     *time.Time `bson:"claimedAt,omitempty" json:"-"`                           // When the current attempt started
+	LastError     string     `bson:"lastError,omitempty" json:"lastError,omitempty"`
+}
+
+// ScheduleStore keeps the messages waiting for their send time
+type ScheduleStore interface {
+	AddScheduled(ctx context.Context, scheduled ScheduledMessage) error
+
+	// A chat's pending messages, soonest first
+	PendingScheduled(ctx context.Context, chatID string) ([]ScheduledMessage, error)
+
+	// Cancel a pending message; false when there is no such pending message
+	CancelScheduled(ctx context.Context, chatID, scheduleID string) (bool, error)
+
+	// Claim the soonest pending message due by now, or one whose claim is
+	// older than scheduleClaimLease, by moving it to sending and counting the
+	// attempt. mongo.ErrNoDocuments when nothing is due.
+	ClaimDueScheduled(ctx context.Context, now time.Time) (ScheduledMessage, error)
+
+	// Store the status, sentAt, msgId, nextAttemptAt and lastError of a claimed message
+	UpdateScheduled(ctx context.Context, scheduled ScheduledMessage) error
+}
+
+func (s *mongoStore) AddScheduled(ctx context.Context, scheduled ScheduledMessage) error {
+	_, err := s.scheduled.InsertOne(ctx, scheduled)
+	return err
+}
+
+func (s *mongoStore) PendingScheduled(ctx context.Context, chatID string) ([]ScheduledMessage, error) {
+	filter := bson.M{"chatId": chatID, "status": scheduledPending}
+	cursor, err := s.scheduled.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "sendAt", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	scheduled := []ScheduledMessage{}
+	err = cursor.All(ctx, &scheduled)
+	return scheduled, err
+}
+
+func (s *mongoStore) CancelScheduled(ctx context.Context, chatID, scheduleID string) (bool, error) {
+	filter := bson.M{"_id": scheduleID, "chatId": chatID, "status": scheduledPending}
+	update := bson.M{"$set": bson.M{"status": scheduledCanceled}}
+	result, err := s.scheduled.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+// Claiming flips the status atomically, so with several instances each
+// message is claimed once per attempt
+func (s *mongoStore) ClaimDueScheduled(ctx context.Context, now time.Time) (ScheduledMessage, error) {
+	var scheduled ScheduledMessage
+	filter := bson.M{"$or": bson.A{
+		bson.M{
+			"status": scheduledPending,
+			"sendAt": bson.M{"$lte": now},
+			"$or":    bson.A{bson.M{"nextAttemptAt": nil}, bson.M{"nextAttemptAt": bson.M{"$lte": now}}},
+		},
+		bson.M{"status": scheduledSending, "claimedAt": bson.M{"$lt": now.Add(-scheduleClaimLease)}},
+	}}
+	update := bson.M{
+		"$set": bson.M{"status": scheduledSending, "claimedAt": now},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().SetSort(bson.D{{Key: "sendAt", Value: 1}}).SetReturnDocument(options.After)
+	err := s.scheduled.FindOneAndUpdate(ctx, filter, update, opts).Decode(&scheduled)
+	return scheduled, err
+}
+
+func (s *mongoStore) UpdateScheduled(ctx context.Context, scheduled ScheduledMessage) error {
+	set := bson.M{"status": scheduled.Status}
+	if scheduled.SentAt != nil {
+		set["sentAt"] = *scheduled.SentAt
+	}
+	if scheduled.MsgID != "" {
+		set["msgId"] = scheduled.MsgID
+	}
+	if scheduled.NextAttemptAt != nil {
+		set["nextAttemptAt"] = *scheduled.NextAttemptAt
+	}
+	if scheduled.LastError != "" {
+		set["lastError"] = scheduled.LastError
+	}
+	_, err := s.scheduled.UpdateOne(ctx, bson.M{"_id": scheduled.ID}, bson.M{"$set": set})
+	return err
+}
+
+func (s *mongoStore) ensureScheduleIndexes(ctx context.Context) error {
+	_, err := s.scheduled.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "sendAt", Value: 1}}},
+		{Keys: bson.D{{Key: "chatId", Value: 1}, {Key: "status", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "claimedAt", Value: 1}}},
+	})
+	return err
+}
+
+// Queue a message to be sent to an active chat later (admins only)
+func scheduleMessage(store ChatStore, schedules ScheduleStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := authenticate(c.Request)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+		if !claims.IsAdmin() {
+			respondError(c, http.StatusForbidden, codeForbidden, "Admin role required")
+			return
+		}
+
+		chatID := c.Param("chatId")
+		var body struct {
+			Message string    `json:"message"`
+			SendAt  time.Time `json:"sendAt"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "Invalid request body")
+			return
+		}
+		// Checked now so the admin hears about blocked words, and again when sent
+		msg, err := validateNewMessage(chatID, ChatMessage{Message: body.Message})
+		if errors.Is(err, errBlockedWords) {
+			respondError(c, http.StatusUnprocessableEntity, codeBlockedWords, err.Error())
+			return
+		}
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		now := time.Now().UTC()
+		if !body.SendAt.After(now) {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "sendAt must be in the future")
+			return
+		}
+
+		ctx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+
+		chat, err := store.GetChat(ctx, chatID)
+		if err == mongo.ErrNoDocuments {
+			respondError(c, http.StatusNotFound, codeChatNotFound, "chat not found")
+			return
+		}
+		if err != nil {
+			slog.Error("Database error while fetching chat", "event", "message_schedule", "chatId", chatID, "error", err)
+			respondDBError(c, err, "Database error")
+			return
+		}
+		if chat.Status != "active" {
+			respondError(c, http.StatusConflict, codeChatClosed, "Chat is closed")
+			return
+		}
+
+		scheduled := ScheduledMessage{
+			ID:         uuid.New().String(),
+			ChatID:     chatID,
+			Sender:     claims.Email,
+			SenderName: claims.DisplayName(),
+			Message:    msg.Message,
+			SendAt:     body.SendAt.UTC(),
+			Status:     scheduledPending,
+			CreatedAt:  now,
+		}
+		if err := schedules.AddScheduled(ctx, scheduled); err != nil {
+			slog.Error("Error scheduling message", "event", "message_schedule", "chatId", chatID, "error", err)
+			respondDBError(c, err, "Could not schedule message")
+			return
+		}
+
+		slog.Info("Message scheduled", "event", "message_schedule", "chatId", chatID, "scheduleId", scheduled.ID, "sendAt", scheduled.SendAt)
+		respond(c, http.StatusCreated, scheduled)
+	}
+}
+
+// List a chat's messages that are still waiting to be sent (admins only)
+func getScheduledMessages(schedules ScheduleStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := authenticate(c.Request)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+		if !claims.IsAdmin() {
+			respondError(c, http.StatusForbidden, codeForbidden, "Admin role required")
+			return
+		}
+		chatID := c.Param("chatId")
+
+		ctx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+
+		scheduled, err := schedules.PendingScheduled(ctx, chatID)
+		if err != nil {
+			slog.Error("Error fetching scheduled messages", "event", "message_schedule", "chatId", chatID, "error", err)
+			respondDBError(c, err, "Database error")
+			return
+		}
+
+		respond(c, http.StatusOK, gin.H{"scheduled": scheduled})
+	}
+}
+
+// Cancel a scheduled message that hasn't been sent yet (admins only)
+func cancelScheduledMessage(schedules ScheduleStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := authenticate(c.Request)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+		if !claims.IsAdmin() {
+			respondError(c, http.StatusForbidden, codeForbidden, "Admin role required")
+			return
+		}
+		chatID := c.Param("chatId")
+		scheduleID := c.Param("scheduleId")
+
+		ctx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+
+		// Only a pending message can be canceled; once claimed by the scheduler it is on its way
+		canceled, err := schedules.CancelScheduled(ctx, chatID, scheduleID)
+		if err != nil {
+			slog.Error("Error canceling scheduled message", "event", "message_schedule", "chatId", chatID, "scheduleId", scheduleID, "error", err)
+			respondDBError(c, err, "Could not cancel scheduled message")
+			return
+		}
+		if !canceled {
+			respondError(c, http.StatusNotFound, codeScheduledNotFound, "no pending scheduled message with that id")
+			return
+		}
+
+		slog.Info("Scheduled message canceled", "event", "message_schedule", "chatId", chatID, "scheduleId", scheduleID, "canceledBy", claims.Email)
+		respond(c, http.StatusOK, gin.H{"message": "Scheduled message canceled"})
+	}
+}
+
+// Send due scheduled messages until ctx is cancelled
+func runScheduler(ctx context.Context, store ChatStore, schedules ScheduleStore) {
+	runSweeper(ctx, schedulePollInterval, func(ctx context.Context) {
+		dispatchDueMessages(ctx, store, schedules)
+	})
+}
+
+// Claim and send every message whose time has come. With several instances
+// each message is claimed, and so sent, once.
+func dispatchDueMessages(parent context.Context, store ChatStore, schedules ScheduleStore) {
+	for {
+		ctx, cancel := dbContext(parent)
+		scheduled, err := schedules.ClaimDueScheduled(ctx, time.Now().UTC())
+		cancel()
+		if err == mongo.ErrNoDocuments {
+			return
+		}
+		if err != nil {
+			slog.Error("Error claiming scheduled message", "event", "message_schedule", "error", err)
+			return
+		}
+		dispatchScheduled(parent, store, schedules, scheduled)
+	}
+}
+
+// saveMessage only appends to active chats, so one closed since scheduling is skipped
+func dispatchScheduled(parent context.Context, store ChatStore, schedules ScheduleStore, scheduled ScheduledMessage) {
+	ctx, cancel := dbContext(parent)
+	defer cancel()
+
+	// The word list may have changed since the message was scheduled. Errors
+	// from validation, such as errBlockedWords, can't be fixed by retrying.
+	msg, permanent := validateNewMessage(scheduled.ChatID, ChatMessage{
+		Sender:     scheduled.Sender,
+		SenderName: scheduled.SenderName,
+		SenderRole: roleAdmin,
+		Message:    scheduled.Message,
+		Timestamp:  time.Now().UTC(),
+		// A reclaimed message may have been stored by the stalled attempt
+		ClientMsgID: scheduled.ID,
+	})
+	if permanent == nil && scheduled.Attempts > scheduleMaxAttempts {
+		// Reclaimed after its last attempt stalled
+		permanent = errNoAttemptsLeft
+	}
+	var saved ChatMessage
+	var err error
+	if permanent == nil {
+		saved, err = saveMessage(ctx, store, scheduled.ChatID, msg)
+	}
+
+	switch {
+	case permanent != nil:
+		scheduled.Status = scheduledFailed
+		scheduled.LastError = permanent.Error()
+		slog.Warn("Scheduled message can't be sent", "event", "message_schedule", "chatId", scheduled.ChatID, "scheduleId", scheduled.ID, "error", permanent)
+	case err == errDuplicateMessage:
+		// Stored by the stalled attempt, which may have broadcast it too
+		scheduled.Status = scheduledSent
+		scheduled.SentAt = &saved.Timestamp
+		scheduled.MsgID = saved.MsgID
+	case errors.Is(err, errChatClosed):
+		scheduled.Status = scheduledSkipped
+		slog.Info("Skipped scheduled message for closed chat", "event", "message_schedule", "chatId", scheduled.ChatID, "scheduleId", scheduled.ID)
+	case err != nil && scheduled.Attempts >= scheduleMaxAttempts:
+		scheduled.Status = scheduledFailed
+		scheduled.LastError = err.Error()
+		slog.Error("Scheduled message failed", "event", "message_schedule", "chatId", scheduled.ChatID, "scheduleId", scheduled.ID, "attempts", scheduled.Attempts, "error", err)
+	case err != nil:
+		// Put it back so a later poll retries
+		scheduled.Status = scheduledPending
+		scheduled.LastError = err.Error()
+		next := time.Now().UTC().Add(scheduleBackoff(scheduled.Attempts))
+		scheduled.NextAttemptAt = &next
+		slog.Error("Error sending scheduled message", "event", "message_schedule", "chatId", scheduled.ChatID, "scheduleId", scheduled.ID, "attempts", scheduled.Attempts, "nextAttemptAt", next, "error", err)
+	default:
+		broadcastMessage(scheduled.ChatID, saved)
+		scheduled.Status = scheduledSent
+		scheduled.SentAt = &saved.Timestamp
+		scheduled.MsgID = saved.MsgID
+	}
+
+	if err := schedules.UpdateScheduled(ctx, scheduled); err != nil {
+		slog.Error("Error updating scheduled message", "event", "message_schedule", "scheduleId", scheduled.ID, "error", err)
+	}
+}
+
+var errNoAttemptsLeft = errors.New("no attempts left")
+
+// Wait before the attempt after the given number of failed ones
+func scheduleBackoff(attempts int) time.Duration {
+	backoff := scheduleRetryBackoff
+	for i := 1; i < attempts && backoff < maxScheduleBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxScheduleBackoff)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The stored state of a scheduled message
+func (f *fakeStore) scheduledMessage(id string) ScheduledMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.scheduled[id]
+}
+
+func TestScheduleMessageRejectsBlockedWords(t *testing.T) {
+	setProfanity(t, "reject", "darn")
+	store := newFakeStore()
+	store.addChat(Chat{ChatID: "c1", UserEmail: "user@example.com"})
+	token := testToken(t, Claims{Email: "agent@example.com", Role: roleAdmin})
+	sendAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	body := strings.NewReader(`{"message":"oh darn","sendAt":"` + sendAt + `"}`)
+	w := serve(http.MethodPost, "/chat/:chatId/schedule", "/chat/c1/schedule", body, token, scheduleMessage(store, store))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want 422: %s", w.Code, w.Body)
+	}
+	if len(store.scheduled) != 0 {
+		t.Errorf("stored %d scheduled messages, want none", len(store.scheduled))
+	}
+}
+
+func TestDispatchScheduled(t *testing.T) {
+	defer func(attempts int) { scheduleMaxAttempts = attempts }(scheduleMaxAttempts)
+	scheduleMaxAttempts = 3
+
+	tests := []struct {
+		name        string
+		chatStatus  string
+		appendErr   error
+		blocked     bool // The word list blocks the message by the time it is sent
+		attempts    int  // Earlier attempts
+		wantStatus  string
+		wantStored  int
+		wantRetry   bool
+		wantLastErr string
+	}{
+		{name: "sent", wantStatus: scheduledSent, wantStored: 1},
+		{name: "chat closed", chatStatus: "ended", wantStatus: scheduledSkipped},
+		{name: "store error retries", appendErr: errors.New("connection reset"), wantStatus: scheduledPending, wantRetry: true, wantLastErr: "connection reset"},
+		{name: "last attempt fails", appendErr: errors.New("connection reset"), attempts: 2, wantStatus: scheduledFailed, wantLastErr: "connection reset"},
+		{name: "blocked words fail at once", blocked: true, wantStatus: scheduledFailed, wantLastErr: errBlockedWords.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.blocked {
+				setProfanity(t, "reject", "darn")
+			}
+			store := newFakeStore()
+			store.addChat(Chat{ChatID: "c1", UserEmail: "user@example.com", Status: tt.chatStatus})
+			store.appendErr = tt.appendErr
+			store.AddScheduled(context.Background(), ScheduledMessage{
+				ID:       "s1",
+				ChatID:   "c1",
+				Sender:   "agent@example.com",
+				Message:  "darn, we're closing soon",
+				SendAt:   time.Now().Add(-time.Minute),
+				Status:   scheduledPending,
+				Attempts: tt.attempts,
+			})
+
+			dispatchDueMessages(context.Background(), store, store)
+
+			got := store.scheduledMessage("s1")
+			if got.Status != tt.wantStatus || got.Attempts != tt.attempts+1 {
+				t.Errorf("status %q after %d attempts, want %q after %d", got.Status, got.Attempts, tt.wantStatus, tt.attempts+1)
+			}
+			if (got.NextAttemptAt != nil) != tt.wantRetry {
+				t.Errorf("nextAttemptAt = %v, want a retry time: %v", got.NextAttemptAt, tt.wantRetry)
+			}
+			if got.NextAttemptAt != nil && !got.NextAttemptAt.After(time.Now()) {
+				t.Errorf("nextAttemptAt %v is not in the future", got.NextAttemptAt)
+			}
+			if got.LastError != tt.wantLastErr {
+				t.Errorf("lastError = %q, want %q", got.LastError, tt.wantLastErr)
+			}
+			chat, _ := store.chat("c1")
+			if len(chat.Messages) != tt.wantStored {
+				t.Errorf("stored %d messages, want %d", len(chat.Messages), tt.wantStored)
+			}
+		})
+	}
+}
+
+func TestDispatchScheduledWaitsForBackoff(t *testing.T) {
+	store := newFakeStore()
+	store.addChat(Chat{ChatID: "c1", UserEmail: "user@example.com"})
+	store.appendErr = errors.New("connection reset")
+	store.AddScheduled(context.Background(), ScheduledMessage{ID: "s1", ChatID: "c1", Message: "hi", SendAt: time.Now().Add(-time.Minute), Status: scheduledPending})
+
+	dispatchDueMessages(context.Background(), store, store)
+	store.appendErr = nil
+	dispatchDueMessages(context.Background(), store, store)
+
+	if got := store.scheduledMessage("s1"); got.Status != scheduledPending || got.Attempts != 1 {
+		t.Errorf("status %q after %d attempts; want pending until the backoff ends", got.Status, got.Attempts)
+	}
+}
+
+func TestDispatchScheduledReclaimsStalledSends(t *testing.T) {
+	tests := []struct {
+		name       string
+		claimedAgo time.Duration
+		stored     bool // The stalled attempt already stored the message
+		wantStatus string
+	}{
+		{"claim within the lease", time.Second, false, scheduledSending},
+		{"expired claim", 2 * scheduleClaimLease, false, scheduledSent},
+		{"expired claim after the message was stored", 2 * scheduleClaimLease, true, scheduledSent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			store.addChat(Chat{ChatID: "c1", UserEmail: "user@example.com"})
+			if tt.stored {
+				saveMessage(context.Background(), store, "c1", ChatMessage{Message: "hi", ClientMsgID: "s1"})
+			}
+			claimedAt := time.Now().Add(-tt.claimedAgo)
+			store.AddScheduled(context.Background(), ScheduledMessage{
+				ID: "s1", ChatID: "c1", Message: "hi", SendAt: time.Now().Add(-time.Hour),
+				Status: scheduledSending, ClaimedAt: &claimedAt, Attempts: 1,
+			})
+
+			dispatchDueMessages(context.Background(), store, store)
+
+			if got := store.scheduledMessage("s1"); got.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", got.Status, tt.wantStatus)
+			}
+			chat, _ := store.chat("c1")
+			if want := btoi(tt.stored || tt.wantStatus == scheduledSent); len(chat.Messages) != want {
+				t.Errorf("stored %d messages, want %d", len(chat.Messages), want)
+			}
+		})
+	}
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestScheduleBackoff(t *testing.T) {
+	defer func(backoff time.Duration) { scheduleRetryBackoff = backoff }(scheduleRetryBackoff)
+	scheduleRetryBackoff = 30 * time.Second
+
+	for attempts, want := range map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		3:  2 * time.Minute,
+		20: maxScheduleBackoff,
+	} {
+		if got := scheduleBackoff(attempts); got != want {
+			t.Errorf("scheduleBackoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
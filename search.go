@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Search limits
+const (
+	defaultSearchLimit   = 20
+	maxSearchLimit       = 100
+	maxSnippetsPerChat   = 3
+	snippetContextLength = 60 // Bytes of context kept on each side of the first match
+)
+
+// SearchResult is a chat matching a search with highlighted snippets
+type SearchResult struct {
+	ChatID    string   `json:"chatId"`
+	UserEmail string   `json:"userEmail"`
+	Status    string   `json:"status"`
+	Score     float64  `json:"score"`
+	Snippets  []string `json:"snippets"`
+}
+
+// SearchQuery selects a page of chats whose messages match a text search
+type SearchQuery struct {
+	Text      string
+	UserEmail string // Only this user's chats, if set
+	Limit     int
+	Skip      int
+}
+
+// SearchHit is a chat matching a search, with its messages and relevance
+type SearchHit struct {
+	Chat  `bson:",inline"`
+	Score float64 `bson:"score"`
+}
+
+// Search chat messages by keyword, ranked by relevance.
+// Customers search their own chats; admins search all chats, or one user's
+// with ?userEmail=.
+func searchChats(store ChatStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := authenticate(c.Request)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		query := strings.TrimSpace(c.Query("q"))
+		if query == "" {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "q is required")
+			return
+		}
+
+		// The searched user always comes from the token, except for admins
+		userEmail := claims.Email
+		if claims.IsAdmin() {
+			userEmail = c.Query("userEmail")
+		}
+
+		limit, skip, ok := parsePagination(c, defaultSearchLimit, maxSearchLimit)
+		if !ok {
+			return
+		}
+
+		ctx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+
+		search := SearchQuery{Text: query, UserEmail: userEmail, Limit: limit, Skip: skip}
+		hits, total, err := store.SearchChats(ctx, search)
+		if err != nil {
+			slog.Error("Database error while searching chats", "event", "search", "userEmail", userEmail, "error", err)
+			respondDBError(c, err, "Database error")
+			return
+		}
+
+		matcher := searchMatcher(query)
+		results := []SearchResult{}
+		for _, hit := range hits {
+			result := SearchResult{
+				ChatID:    hit.ChatID,
+				UserEmail: hit.UserEmail,
+				Status:    hit.Status,
+				Score:     hit.Score,
+				Snippets:  []string{},
+			}
+			for _, msg := range hit.Messages {
+				if snippet, ok := highlight(msg.Message, matcher); ok {
+					result.Snippets = append(result.Snippets, snippet)
+					if len(result.Snippets) == maxSnippetsPerChat {
+						break
+					}
+				}
+			}
+			results = append(results, result)
+		}
+
+		pagination := paginate(c, limit, skip, total)
+		respond(c, http.StatusOK, gin.H{"results": results, "pagination": pagination})
+	}
+}
+
+func (s *mongoStore) SearchChats(ctx context.Context, query SearchQuery) ([]SearchHit, int64, error) {
+	filter := bson.M{"$text": bson.M{"$search": query.Text}}
+	if query.UserEmail != "" {
+		filter["userEmail"] = query.UserEmail
+	}
+	total, err := s.chats.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	score := bson.M{"$meta": "textScore"}
+	opts := options.Find().
+		SetProjection(bson.M{"chatId": 1, "userEmail": 1, "status": 1, "messages": 1, "score": score}).
+		SetSort(bson.M{"score": score}).
+		SetSkip(int64(query.Skip)).
+		SetLimit(int64(query.Limit))
+	cursor, err := s.chats.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	var hits []SearchHit
+	if err := cursor.All(ctx, &hits); err != nil {
+		return nil, 0, err
+	}
+	return hits, total, nil
+}
+
+// Build a case-insensitive matcher for the words of a text search query
+func searchMatcher(query string) *regexp.Regexp {
+	var terms []string
+	for _, word := range strings.Fields(query) {
+		word = strings.Trim(word, `"-`)
+		if word != "" {
+			terms = append(terms, regexp.QuoteMeta(word))
+		}
+	}
+	if len(terms) == 0 {
+		return nil
+	}
+	return regexp.MustCompile(`(?i)(` + strings.Join(terms, "|") + `)`)
+}
+
+// Cut a snippet around the first match and wrap every match in <mark> tags
+func highlight(text string, matcher *regexp.Regexp) (string, bool) {
+	if matcher == nil {
+		return "", false
+	}
+	loc := matcher.FindStringIndex(text)
+	if loc == nil {
+		return "", false
+	}
+
+	start := max(loc[0]-snippetContextLength, 0)
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	end := min(loc[1]+snippetContextLength, len(text))
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+
+	snippet := matcher.ReplaceAllString(text[start:end], "<mark>$1</mark>")
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(text) {
+		snippet += "…"
+	}
+	return snippet, true
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSearchChatsScope(t *testing.T) {
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		token      *Claims
+		query      string
+		wantStatus int
+		wantChats  string
+	}{
+		{
+			name:       "customer searches their own chats",
+			token:      &Claims{Email: "user@example.com"},
+			query:      "?q=refund",
+			wantStatus: http.StatusOK,
+			wantChats:  "c1",
+		},
+		{
+			name:       "customer can't search another user's chats",
+			token:      &Claims{Email: "user@example.com"},
+			query:      "?q=refund&userEmail=other@example.com",
+			wantStatus: http.StatusOK,
+			wantChats:  "c1",
+		},
+		{
+			name:       "userStatus doesn't widen a customer search",
+			token:      &Claims{Email: "user@example.com"},
+			query:      "?q=refund&userStatus=admin",
+			wantStatus: http.StatusOK,
+			wantChats:  "c1",
+		},
+		{
+			name:       "admin searches all chats",
+			token:      &Claims{Email: "agent@example.com", Role: roleAdmin},
+			query:      "?q=refund",
+			wantStatus: http.StatusOK,
+			wantChats:  "c1,c2",
+		},
+		{
+			name:       "admin searches one user's chats",
+			token:      &Claims{Email: "agent@example.com", Role: roleAdmin},
+			query:      "?q=refund&userEmail=other@example.com",
+			wantStatus: http.StatusOK,
+			wantChats:  "c2",
+		},
+		{
+			name:       "missing token",
+			query:      "?q=refund&userEmail=user@example.com",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "missing query",
+			token:      &Claims{Email: "user@example.com"},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			for _, chat := range []Chat{testChat("c1", 2, base), testChat("c2", 2, base)} {
+				chat.Messages[0].Message = "I want a refund"
+				if chat.ChatID == "c2" {
+					chat.UserEmail = "other@example.com"
+				}
+				store.addChat(chat)
+			}
+			token := ""
+			if tt.token != nil {
+				token = testToken(t, *tt.token)
+			}
+
+			w := serve(http.MethodGet, "/search", "/search"+tt.query, nil, token, searchChats(store))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var got struct {
+				Results []SearchResult `json:"results"`
+			}
+			decodeEnvelope(t, w, &got)
+			var chats []string
+			for _, result := range got.Results {
+				chats = append(chats, result.ChatID)
+			}
+			sort.Strings(chats)
+			if ids := strings.Join(chats, ","); ids != tt.wantChats {
+				t.Errorf("chats = %s, want %s", ids, tt.wantChats)
+			}
+		})
+	}
+}
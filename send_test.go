@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostMessageWriteFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{"store error", errors.New("connection reset"), http.StatusInternalServerError, codeDatabaseError},
+		{"timeout", context.DeadlineExceeded, http.StatusGatewayTimeout, codeDatabaseTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestRegistry(t)
+			listener := addTestClient(t, "conn-1", "c1", "agent@example.com", time.Now())
+			store := newFakeStore()
+			store.addChat(Chat{ChatID: "c1", UserEmail: "user@example.com"})
+			store.appendErr = tt.err
+
+			token := testToken(t, Claims{Email: "user@example.com"})
+			w := serve(http.MethodPost, "/chat/:chatId/message", "/chat/c1/message", strings.NewReader(`{"message":"hello"}`), token, postMessage(store))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if apiErr := decodeEnvelope(t, w, nil); apiErr == nil || apiErr.Code != tt.wantCode {
+				t.Errorf("error = %+v, want code %s", apiErr, tt.wantCode)
+			}
+			if len(listener.send) != 0 {
+				t.Errorf("broadcast %d frames for an unsaved message", len(listener.send))
+			}
+		})
+	}
+}
+
+func TestSendMessageWriteFailureNacks(t *testing.T) {
+	store := newFakeStore()
+	store.addChat(Chat{ChatID: testChatID, UserEmail: "user@example.com"})
+	url := startWS(t, store)
+	ws := dialChat(t, url, Claims{Email: "user@example.com"}, map[string]string{"chatId": testChatID})
+	readFrame(t, ws, "init")
+
+	store.mu.Lock()
+	store.appendErr = errors.New("connection reset")
+	store.mu.Unlock()
+	ws.WriteJSON(map[string]string{"type": "message", "message": "hello", "clientMsgId": "c-1"})
+	nack := readFrame(t, ws, "nack")
+	if nack["clientMsgId"] != "c-1" || nack["error"] != "Could not save message" {
+		t.Errorf("nack = %v", nack)
+	}
+
+	// The client retries with the same ID once the store recovers
+	store.mu.Lock()
+	store.appendErr = nil
+	store.mu.Unlock()
+	ws.WriteJSON(map[string]string{"type": "message", "message": "hello", "clientMsgId": "c-1"})
+	if ack := readFrame(t, ws, "ack"); ack["clientMsgId"] != "c-1" || ack["msgId"] == "" {
+		t.Errorf("ack = %v", ack)
+	}
+	chat, _ := store.chat(testChatID)
+	if len(chat.Messages) != 1 {
+		t.Errorf("stored %d messages, want 1", len(chat.Messages))
+	}
+}
+
+func TestPostMessageParticipants(t *testing.T) {
+	tests := []struct {
+		name       string
+		claims     Claims
+		wantStatus int
+	}{
+		{"chat owner", Claims{Email: "user@example.com"}, http.StatusCreated},
+		{"admin", Claims{Email: "agent@example.com", Role: roleAdmin}, http.StatusCreated},
+		{"another customer", Claims{Email: "other@example.com"}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestRegistry(t)
+			store := newFakeStore()
+			store.addChat(Chat{ChatID: "c1", UserEmail: "user@example.com"})
+
+			body := strings.NewReader(`{"message":"hello"}`)
+			w := serve(http.MethodPost, "/chat/:chatId/message", "/chat/c1/message", body, testToken(t, tt.claims), postMessage(store))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusForbidden {
+				if apiErr := decodeEnvelope(t, w, nil); apiErr == nil || apiErr.Code != codeForbidden {
+					t.Errorf("error = %+v, want code %s", apiErr, codeForbidden)
+				}
+			}
+			chat, _ := store.chat("c1")
+			if stored := len(chat.Messages) > 0; stored != (tt.wantStatus == http.StatusCreated) {
+				t.Errorf("stored %d messages for status %d", len(chat.Messages), w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ChatStats summarizes chats for the admin dashboard
+type ChatStats struct {
+	ActiveChats            int     `bson:"activeChats" json:"activeChats"`
+	EndedChats             int     `bson:"endedChats" json:"endedChats"`
+	TotalMessages          int     `bson:"totalMessages" json:"totalMessages"`
+	AvgMessagesPerChat     float64 `bson:"avgMessagesPerChat" json:"avgMessagesPerChat"`
+	AvgChatDurationSeconds float64 `bson:"avgChatDurationSeconds" json:"avgChatDurationSeconds"` // Over ended chats with createdAt and closedAt
+}
+
+// Report chat KPIs (admins only), optionally for chats created between
+// from and to (RFC3339). Everything is computed in one aggregation.
+func getStats(store ChatStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := authenticate(c.Request)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+		if !claims.IsAdmin() {
+			respondError(c, http.StatusForbidden, codeForbidden, "Admin role required")
+			return
+		}
+
+		var from, to *time.Time
+		for param, bound := range map[string]**time.Time{"from": &from, "to": &to} {
+			value := c.Query(param)
+			if value == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				respondError(c, http.StatusBadRequest, codeInvalidRequest, param+" must be an RFC3339 timestamp")
+				return
+			}
+			*bound = &t
+		}
+
+		ctx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+
+		stats, err := store.Stats(ctx, from, to)
+		if err != nil {
+			slog.Error("Database error while computing stats", "event", "stats", "error", err)
+			respondDBError(c, err, "Database error")
+			return
+		}
+
+		respond(c, http.StatusOK, stats)
+	}
+}
+
+// Count a user's chats by status without fetching them. Users may count
+// their own chats; admins may count anyone's.
+func getUserChatCounts(store ChatStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := authenticate(c.Request)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		userEmail := c.Param("userEmail")
+		if userEmail == "" {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "userEmail is required")
+			return
+		}
+		if claims.Email != userEmail && !claims.IsAdmin() {
+			respondError(c, http.StatusForbidden, codeForbidden, "You can only count your own chats")
+			return
+		}
+
+		ctx, cancel := dbContext(c.Request.Context())
+		defer cancel()
+
+		byStatus, err := store.CountByStatus(ctx, userEmail)
+		if err != nil {
+			slog.Error("Database error while counting user chats", "event", "chat_counts", "userEmail", userEmail, "error", err)
+			respondDBError(c, err, "Database error")
+			return
+		}
+
+		counts := gin.H{"active": int64(0), "ended": int64(0)}
+		for status, count := range byStatus {
+			counts[status] = count
+		}
+
+		respond(c, http.StatusOK, counts)
+	}
+}
+
+func (s *mongoStore) Stats(ctx context.Context, from, to *time.Time) (ChatStats, error) {
+	match := bson.M{}
+	created := bson.M{}
+	if from != nil {
+		created["$gte"] = *from
+	}
+	if to != nil {
+		created["$lte"] = *to
+	}
+	if len(created) > 0 {
+		match["createdAt"] = created
+	}
+
+	countStatus := func(status string) bson.M {
+		return bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$status", status}}, 1, 0}}}
+	}
+	messageCount := bson.M{"$size": bson.M{"$ifNull": bson.A{"$messages", bson.A{}}}}
+	// Non-ended chats and chats from before createdAt/closedAt were recorded
+	// yield null, which $avg skips
+	duration := bson.M{"$cond": bson.A{
+		bson.M{"$and": bson.A{
+			bson.M{"$eq": bson.A{"$status", "ended"}},
+			bson.M{"$eq": bson.A{bson.M{"$type": "$createdAt"}, "date"}},
+			bson.M{"$eq": bson.A{bson.M{"$type": "$closedAt"}, "date"}},
+		}},
+		bson.M{"$divide": bson.A{bson.M{"$subtract": bson.A{"$closedAt", "$createdAt"}}, 1000}},
+		nil,
+	}}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id":                    nil,
+			"activeChats":            countStatus("active"),
+			"endedChats":             countStatus("ended"),
+			"totalMessages":          bson.M{"$sum": messageCount},
+			"avgMessagesPerChat":     bson.M{"$avg": messageCount},
+			"avgChatDurationSeconds": bson.M{"$avg": duration},
+		}}},
+	}
+
+	var stats ChatStats
+	cursor, err := s.chats.Aggregate(ctx, pipeline)
+	if err != nil {
+		return stats, err
+	}
+	defer cursor.Close(ctx)
+
+	// No matching chats leaves every figure at zero
+	if cursor.Next(ctx) {
+		err = cursor.Decode(&stats)
+	} else {
+		err = cursor.Err()
+	}
+	return stats, err
+}
+
+func (s *mongoStore) CountByStatus(ctx context.Context, userEmail string) (map[string]int64, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"userEmail": userEmail}}},
+		{{Key: "$group", Value: bson.M{"_id": "$status", "count": bson.M{"$sum": 1}}}},
+	}
+
+	cursor, err := s.chats.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		Status string `bson:"_id"`
+		Count  int64  `bson:"count"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64, len(groups))
+	for _, group := range groups {
+		counts[group.Status] = group.Count
+	}
+	return counts, nil
+}
@@ -0,0 +1,777 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ChatStore is the chat persistence the handlers are given, so they can run
+// against a fake or another backend instead of a live MongoDB cluster.
+// Lookups of a missing chat return mongo.ErrNoDocuments unless noted.
+type ChatStore interface {
+	// A chat's metadata and lastMessage, without messages
+	GetChat(ctx context.Context, chatID string) (Chat, error)
+
+	// A user's chats with the given status, most recent activity first
+	FindByUser(ctx context.Context, userEmail, status string) ([]Chat, error)
+
+	// A page of active chats with unread counts, and how many match in total
+	FindActive(ctx context.Context, query ActiveChatsQuery) ([]ChatSummary, int64, error)
+
+	// A page of chats of any status without messages, and how many match in total
+	ListChats(ctx context.Context, query ChatListQuery) ([]Chat, int64, error)
+
+	// ID of the user's active chat, "" when there is none
+	ActiveChatID(ctx context.Context, userEmail string) (string, error)
+
+	// IDs of every chat matching the query
+	FindChatIDs(ctx context.Context, query ChatIDQuery) ([]string, error)
+
+	// Create the chat unless one with its ID exists; true when it was created.
+	// errActiveChatExists when the user already has another active chat.
+	CreateChat(ctx context.Context, chat Chat) (bool, error)
+
+	// Change a chat's status; ending records who did it and when.
+	// false when there is no such chat.
+	SetStatus(ctx context.Context, chatID, status, changedBy string, at time.Time) (bool, error)
+
+	// Make an ended chat active again. false when there is no ended chat with
+	// that ID; errActiveChatExists when its user has another active chat.
+	ReopenChat(ctx context.Context, chatID, reopenedBy string, at time.Time) (bool, error)
+
+	// Delete chats with their archived messages and return how many chats went.
+	// A status, if set, only deletes chats that still have it.
+	DeleteChats(ctx context.Context, chatIDs []string, status string) (int64, error)
+
+	// Assign an active chat to an admin if its current assignee is one of from,
+	// where "" stands for unassigned and a nil from accepts anyone.
+	// false when no active chat matched.
+	AssignChat(ctx context.Context, chatID, to string, from []string, at time.Time) (bool, error)
+
+	// Add and remove lowercase tags and return the chat's tags afterwards
+	UpdateTags(ctx context.Context, chatID string, add, remove []string) ([]string, error)
+
+	// Set and remove top-level metadata keys and return the metadata afterwards.
+	// Returns errMetadataConflict when the metadata is no longer at revision rev.
+	UpdateMetadata(ctx context.Context, chatID string, rev int64, set map[string]interface{}, unset []string) (map[string]interface{}, error)
+
+	// Move a guest's chats and messages to userEmail and return how many chats
+	// moved. errActiveChatExists when both have an active chat.
+	ReassignGuestChats(ctx context.Context, guestID, userEmail string) (int64, error)
+
+	// A page of chats matching a text search, best first, and how many match in total
+	SearchChats(ctx context.Context, query SearchQuery) ([]SearchHit, int64, error)
+
+	// Dashboard figures over the chats created within the optional bounds
+	Stats(ctx context.Context, from, to *time.Time) (ChatStats, error)
+
+	// How many chats the user has per status
+	CountByStatus(ctx context.Context, userEmail string) (map[string]int64, error)
+
+	// Append a message to an active chat and return its seq and the chat's
+	// message count. errChatClosed when no active chat took it, which
+	// includes a clientMsgId that is already stored.
+	AppendMessage(ctx context.Context, chatID string, msg ChatMessage) (seq int64, count int, err error)
+
+	// Newest page of the live messages matching the query
+	HistoryPage(ctx context.Context, chatID string, query HistoryQuery) (HistoryPage, error)
+
+	// Newest archived messages matching the query, oldest first, and whether
+	// older ones remain
+	ArchivedHistory(ctx context.Context, chatID string, query HistoryQuery) ([]ArchivedMessage, bool, error)
+
+	// Move the oldest messages of a chat holding count messages to the archive
+	ArchiveOverflow(ctx context.Context, chatID string, count int) error
+
+	// Messages newer than a marker, oldest first: the ID of the last message
+	// the client has, or else its timestamp. At most the oldest limit are
+	// returned, with whether more follow them.
+	MessagesSince(ctx context.Context, chatID, lastMessageID string, since time.Time, limit int) ([]ChatMessage, bool, error)
+
+	// Call fn with every message of a chat in order, archived ones first.
+	// Errors opening the chat are returned before fn is first called.
+	ExportMessages(ctx context.Context, chatID string, fn func(ChatMessage) error) error
+
+	// A message of a chat by its ID, or errMessageNotFound. A message moved to
+	// the archive is returned together with errMessageArchived.
+	FindMessage(ctx context.Context, chatID, msgID string) (ChatMessage, error)
+
+	// A message of a chat by its client-generated ID, like FindMessage
+	FindMessageByClientID(ctx context.Context, chatID, clientMsgID string) (ChatMessage, error)
+
+	// Replace the text of a message sent by sender, keeping previous in its
+	// edit history when set. lastMessage follows when it is that message.
+	EditMessage(ctx context.Context, chatID, msgID, sender, text string, at time.Time, previous *EditRecord) error
+
+	// Flag a message deleted, unpin it and blank its text, also in lastMessage
+	// and in the previews of replies quoting it
+	DeleteMessage(ctx context.Context, chatID, msgID string) error
+
+	SetPinned(ctx context.Context, chatID, msgID string, pinned bool) error
+
+	// Pinned messages of a chat in chat order
+	PinnedMessages(ctx context.Context, chatID string) ([]ChatMessage, error)
+
+	// Add the user to the emoji's reactions of a message that isn't deleted, or
+	// remove them if they already reacted with it. errMessageNotFound when
+	// there is no such message.
+	ToggleReaction(ctx context.Context, chatID, msgID, userEmail, emoji string) error
+
+	// Append an attachment to a message sent by sender. false when the message
+	// already has maxAttachmentsPerMessage.
+	AddAttachment(ctx context.Context, chatID, msgID, sender string, attachment Attachment) (bool, error)
+
+	// Add reader to the readBy list of the listed messages
+	MarkRead(ctx context.Context, chatID string, msgIDs []string, reader string) error
+
+	// Add reader to the readBy list of every message. An owner, if set, must be
+	// the chat's user. Reports whether the chat matched and whether anything changed.
+	MarkAllRead(ctx context.Context, chatID, reader, owner string) (found, changed bool, err error)
+}
+
+// ActiveChatsQuery selects a page of active chats
+type ActiveChatsQuery struct {
+	Tag           string // Lowercase tag the chats must carry, if set
+	SortByWaiting bool   // Longest-waiting customers first instead of most recent activity
+	Limit         int
+	Skip          int
+}
+
+// HistoryQuery selects a page of a chat's history
+type HistoryQuery struct {
+	Limit       int
+	BeforeIndex *int       // Global message index, counting archived messages
+	BeforeTime  *time.Time // Only messages sent before this
+	Sender      string
+	Role        string
+}
+
+// ChatListQuery selects a page of chats of any status
+type ChatListQuery struct {
+	Status     string
+	UserEmail  string
+	AssignedTo string
+	Tag        string     // Lowercase tag the chats must carry, if set
+	From, To   *time.Time // Bounds on lastMessageTime
+	ByClosedAt bool       // Most recently closed first instead of most recent activity
+	Limit      int
+	Skip       int
+}
+
+// ChatIDQuery selects chats by owner, status and age; unset fields match anything
+type ChatIDQuery struct {
+	UserEmail     string
+	Status        string
+	CreatedBefore *time.Time
+	IdleBefore    *time.Time // Last message, or creation before the first one, before this
+	ClosedBefore  *time.Time // Closed, or last active when closedAt wasn't recorded, before this
+}
+
+var errActiveChatExists = errors.New("user already has an active chat")
+
+// HistoryPage is the tail of a chat's live messages matching a query
+type HistoryPage struct {
+	Total         int           `bson:"total"` // Live messages matching the query, before limiting
+	Messages      []ChatMessage `bson:"messages"`
+	ArchivedCount int           `bson:"archivedCount"`
+}
+
+// mongoStore keeps chats, with their messages inline, in one collection and
+// the messages that overflow them in another. Bans and scheduled messages
+// have a collection each.
+type mongoStore struct {
+	chats     *mongo.Collection
+	archive   *mongo.Collection
+	bans      *mongo.Collection
+	scheduled *mongo.Collection
+}
+
+var (
+	_ ChatStore     = (*mongoStore)(nil)
+	_ BanStore      = (*mongoStore)(nil)
+	_ ScheduleStore = (*mongoStore)(nil)
+)
+
+func newMongoStore(database *mongo.Database) *mongoStore {
+	return &mongoStore{
+		chats:     database.Collection(getEnv("MONGODB_COLLECTION", "chats")),
+		archive:   database.Collection(getEnv("MONGODB_ARCHIVE_COLLECTION", "chat_archive")),
+		bans:      database.Collection(getEnv("MONGODB_BANS_COLLECTION", "banned_users")),
+		scheduled: database.Collection(getEnv("MONGODB_SCHEDULED_COLLECTION", "scheduled_messages")),
+	}
+}
+
+func (s *mongoStore) GetChat(ctx context.Context, chatID string) (Chat, error) {
+	var chat Chat
+	projection := options.FindOne().SetProjection(bson.M{"messages": 0})
+	err := s.chats.FindOne(ctx, bson.M{"chatId": chatID}, projection).Decode(&chat)
+	return chat, err
+}
+
+func (s *mongoStore) FindByUser(ctx context.Context, userEmail, status string) ([]Chat, error) {
+	sortByRecency := options.Find().SetSort(bson.M{"lastMessageTime": -1})
+	cursor, err := s.chats.Find(ctx, bson.M{"userEmail": userEmail, "status": status}, sortByRecency)
+	if err != nil {
+		return nil, err
+	}
+	var chats []Chat
+	err = cursor.All(ctx, &chats)
+	return chats, err
+}
+
+func (s *mongoStore) FindActive(ctx context.Context, query ActiveChatsQuery) ([]ChatSummary, int64, error) {
+	// A customer message is unread while nobody but the customer is in its readBy list
+	unread := bson.M{"$filter": bson.M{
+		"input": bson.M{"$ifNull": bson.A{"$messages", bson.A{}}},
+		"as":    "m",
+		"cond": bson.M{"$and": bson.A{
+			bson.M{"$eq": bson.A{"$$m.senderRole", roleCustomer}},
+			bson.M{"$eq": bson.A{
+				bson.M{"$size": bson.M{"$setDifference": bson.A{
+					bson.M{"$ifNull": bson.A{"$$m.readBy", bson.A{}}},
+					bson.A{"$userEmail"},
+				}}},
+				0,
+			}},
+		}},
+	}}
+
+	// The customer has been waiting since their first message after the last
+	// agent or bot reply; system notices don't count as a reply
+	waitingSince := bson.M{"$reduce": bson.M{
+		"input":        bson.M{"$ifNull": bson.A{"$messages", bson.A{}}},
+		"initialValue": nil,
+		"in": bson.M{"$switch": bson.M{
+			"branches": bson.A{
+				bson.M{
+					"case": bson.M{"$and": bson.A{
+						bson.M{"$eq": bson.A{"$$this.senderRole", roleCustomer}},
+						bson.M{"$eq": bson.A{"$$value", nil}},
+					}},
+					"then": "$$this.timestamp",
+				},
+				bson.M{
+					"case": bson.M{"$in": bson.A{"$$this.senderRole", bson.A{roleAdmin, roleBot}}},
+					"then": nil,
+				},
+			},
+			"default": "$$value",
+		}},
+	}}
+
+	match := bson.M{"status": "active"}
+	if query.Tag != "" {
+		match["tags"] = query.Tag
+	}
+	var pipeline mongo.Pipeline
+	if query.SortByWaiting {
+		// Waiting time decides the order, so it is computed for every chat; those
+		// not waiting come last
+		pipeline = mongo.Pipeline{
+			{{Key: "$match", Value: match}},
+			{{Key: "$addFields", Value: bson.M{"waitingSince": waitingSince}}},
+			{{Key: "$addFields", Value: bson.M{"waiting": bson.M{"$ne": bson.A{"$waitingSince", nil}}}}},
+			{{Key: "$sort", Value: bson.D{{Key: "waiting", Value: -1}, {Key: "waitingSince", Value: 1}, {Key: "_id", Value: 1}}}},
+			{{Key: "$skip", Value: query.Skip}},
+			{{Key: "$limit", Value: query.Limit}},
+		}
+	} else {
+		// Page first so the computed fields are only built for the returned chats
+		pipeline = mongo.Pipeline{
+			{{Key: "$match", Value: match}},
+			{{Key: "$sort", Value: bson.D{{Key: "lastMessageTime", Value: -1}, {Key: "_id", Value: -1}}}},
+			{{Key: "$skip", Value: query.Skip}},
+			{{Key: "$limit", Value: query.Limit}},
+			{{Key: "$addFields", Value: bson.M{"waitingSince": waitingSince}}},
+		}
+	}
+	pipeline = append(pipeline,
+		bson.D{{Key: "$addFields", Value: bson.M{"unreadCount": bson.M{"$size": unread}}}},
+		bson.D{{Key: "$project", Value: bson.M{"messages": 0, "waiting": 0}}},
+	)
+
+	total, err := s.chats.CountDocuments(ctx, match)
+	if err != nil {
+		return nil, 0, err
+	}
+	cursor, err := s.chats.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, 0, err
+	}
+	var chats []ChatSummary
+	if err := cursor.All(ctx, &chats); err != nil {
+		return nil, 0, err
+	}
+	return chats, total, nil
+}
+
+func (s *mongoStore) AppendMessage(ctx context.Context, chatID string, msg ChatMessage) (int64, int, error) {
+	// Only an existing, active chat takes new messages
+	filter := bson.M{"chatId": chatID, "status": "active"}
+	if msg.ClientMsgID != "" {
+		// Only push if this client message isn't stored yet
+		filter["messages.clientMsgId"] = bson.M{"$ne": msg.ClientMsgID}
+	}
+	// One pipeline update bumps the chat's seq counter and appends the message
+	// stamped with it, so array order always matches seq order. The message is
+	// a $literal so text starting with $ isn't read as a field path.
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"seq": bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$seq", 0}}, 1}},
+		}}},
+		{{Key: "$set", Value: bson.M{
+			"lastMessage":     bson.M{"$mergeObjects": bson.A{bson.M{"$literal": msg}, bson.M{"seq": "$seq"}}},
+			"lastMessageTime": msg.Timestamp,
+		}}},
+		{{Key: "$set", Value: bson.M{
+			"messages": bson.M{"$concatArrays": bson.A{bson.M{"$ifNull": bson.A{"$messages", bson.A{}}}, bson.A{"$lastMessage"}}},
+		}}},
+	}
+
+	options := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(bson.M{"seq": 1, "messageCount": bson.M{"$size": "$messages"}})
+
+	var counter struct {
+		Seq          int64 `bson:"seq"`
+		MessageCount int   `bson:"messageCount"`
+	}
+	err := s.chats.FindOneAndUpdate(ctx, filter, update, options).Decode(&counter)
+	if err == mongo.ErrNoDocuments {
+		return 0, 0, errChatClosed
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return counter.Seq, counter.MessageCount, nil
+}
+
+func (s *mongoStore) SetStatus(ctx context.Context, chatID, status, changedBy string, at time.Time) (bool, error) {
+	filter := bson.M{"chatId": chatID}
+	set := bson.M{"status": status}
+	if status == "ended" {
+		set["closedAt"] = at
+		set["closedBy"] = changedBy
+	}
+	update := bson.M{"$set": set}
+
+	result, err := s.chats.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+func (s *mongoStore) HistoryPage(ctx context.Context, chatID string, query HistoryQuery) (HistoryPage, error) {
+	// Narrow the messages array down to everything older than the cursor.
+	// Archived messages come before the array, so an index cursor is offset
+	// by how many were archived.
+	var messages interface{} = "$messages"
+	if query.BeforeIndex != nil {
+		liveIdx := bson.M{"$max": bson.A{bson.M{"$subtract": bson.A{*query.BeforeIndex, bson.M{"$ifNull": bson.A{"$archivedCount", 0}}}}, 0}}
+		messages = bson.M{"$slice": bson.A{"$messages", liveIdx}}
+	} else if query.BeforeTime != nil {
+		messages = bson.M{"$filter": bson.M{
+			"input": "$messages",
+			"as":    "m",
+			"cond":  bson.M{"$lt": bson.A{"$$m.timestamp", *query.BeforeTime}},
+		}}
+	}
+
+	// Then keep only the requested senders
+	var conditions bson.A
+	if query.Sender != "" {
+		conditions = append(conditions, bson.M{"$eq": bson.A{"$$m.sender", query.Sender}})
+	}
+	if query.Role != "" {
+		conditions = append(conditions, bson.M{"$eq": bson.A{"$$m.senderRole", query.Role}})
+	}
+	if len(conditions) > 0 {
+		messages = bson.M{"$filter": bson.M{
+			"input": bson.M{"$ifNull": bson.A{messages, bson.A{}}},
+			"as":    "m",
+			"cond":  bson.M{"$and": conditions},
+		}}
+	}
+
+	// saveMessage appends in seq order, so the array is already sorted by seq
+	// and index cursors stay stable
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"chatId": chatID}}},
+		{{Key: "$project", Value: bson.M{
+			"messages":      bson.M{"$ifNull": bson.A{messages, bson.A{}}},
+			"archivedCount": bson.M{"$ifNull": bson.A{"$archivedCount", 0}},
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"total":         bson.M{"$size": "$messages"},
+			"messages":      bson.M{"$slice": bson.A{"$messages", -query.Limit}},
+			"archivedCount": 1,
+		}}},
+	}
+
+	var page HistoryPage
+	cursor, err := s.chats.Aggregate(ctx, pipeline)
+	if err != nil {
+		return page, err
+	}
+	defer cursor.Close(ctx)
+
+	if !cursor.Next(ctx) {
+		if err := cursor.Err(); err != nil {
+			return page, err
+		}
+		return page, mongo.ErrNoDocuments
+	}
+	err = cursor.Decode(&page)
+	return page, err
+}
+
+func (s *mongoStore) ListChats(ctx context.Context, query ChatListQuery) ([]Chat, int64, error) {
+	filter := bson.M{}
+	if query.Status != "" {
+		filter["status"] = query.Status
+	}
+	if query.UserEmail != "" {
+		filter["userEmail"] = query.UserEmail
+	}
+	if query.AssignedTo != "" {
+		filter["assignedTo"] = query.AssignedTo
+	}
+	if query.Tag != "" {
+		filter["tags"] = query.Tag
+	}
+	activity := bson.M{}
+	if query.From != nil {
+		activity["$gte"] = *query.From
+	}
+	if query.To != nil {
+		activity["$lte"] = *query.To
+	}
+	if len(activity) > 0 {
+		filter["lastMessageTime"] = activity
+	}
+
+	total, err := s.chats.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sort := bson.D{{Key: "lastMessageTime", Value: -1}, {Key: "_id", Value: -1}}
+	if query.ByClosedAt {
+		sort = append(bson.D{{Key: "closedAt", Value: -1}}, sort...)
+	}
+	// Only metadata and lastMessage
+	opts := options.Find().
+		SetProjection(bson.M{"messages": 0}).
+		SetSort(sort).
+		SetSkip(int64(query.Skip)).
+		SetLimit(int64(query.Limit))
+	cursor, err := s.chats.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	chats := []Chat{}
+	if err := cursor.All(ctx, &chats); err != nil {
+		return nil, 0, err
+	}
+	return chats, total, nil
+}
+
+func (s *mongoStore) ActiveChatID(ctx context.Context, userEmail string) (string, error) {
+	var chat Chat
+	projection := options.FindOne().SetProjection(bson.M{"chatId": 1})
+	err := s.chats.FindOne(ctx, bson.M{"userEmail": userEmail, "status": "active"}, projection).Decode(&chat)
+	if err == mongo.ErrNoDocuments {
+		return "", nil
+	}
+	return chat.ChatID, err
+}
+
+func (s *mongoStore) FindChatIDs(ctx context.Context, query ChatIDQuery) ([]string, error) {
+	filter := bson.M{}
+	if query.UserEmail != "" {
+		filter["userEmail"] = query.UserEmail
+	}
+	if query.Status != "" {
+		filter["status"] = query.Status
+	}
+	if query.CreatedBefore != nil {
+		filter["createdAt"] = bson.M{"$lt": *query.CreatedBefore}
+	}
+	var or bson.A
+	if query.IdleBefore != nil {
+		or = bson.A{
+			bson.M{"lastMessageTime": bson.M{"$lt": *query.IdleBefore}},
+			bson.M{"lastMessageTime": bson.M{"$exists": false}, "createdAt": bson.M{"$lt": *query.IdleBefore}},
+		}
+	}
+	if query.ClosedBefore != nil {
+		or = bson.A{
+			bson.M{"closedAt": bson.M{"$lt": *query.ClosedBefore}},
+			bson.M{"closedAt": bson.M{"$exists": false}, "lastMessageTime": bson.M{"$lt": *query.ClosedBefore}},
+		}
+	}
+	if or != nil {
+		filter["$or"] = or
+	}
+
+	values, err := s.chats.Distinct(ctx, "chatId", filter)
+	if err != nil {
+		return nil, err
+	}
+	chatIDs := make([]string, 0, len(values))
+	for _, value := range values {
+		if chatID, ok := value.(string); ok {
+			chatIDs = append(chatIDs, chatID)
+		}
+	}
+	return chatIDs, nil
+}
+
+func (s *mongoStore) CreateChat(ctx context.Context, chat Chat) (bool, error) {
+	onInsert := bson.M{
+		"userEmail":       chat.UserEmail,
+		"messages":        []ChatMessage{},
+		"status":          "active",
+		"createdAt":       chat.CreatedAt,
+		"lastMessageTime": chat.CreatedAt, // So listings order chats without messages too
+	}
+	if chat.GuestID != "" {
+		onInsert["guestId"] = chat.GuestID
+	}
+	if len(chat.Metadata) > 0 {
+		onInsert["metadata"] = chat.Metadata
+	}
+
+	// An existing chat is left as it is, whatever its status
+	update := bson.M{"$setOnInsert": onInsert}
+	result, err := s.chats.UpdateOne(ctx, bson.M{"chatId": chat.ChatID}, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, errActiveChatExists
+	}
+	if err != nil {
+		return false, err
+	}
+	return result.UpsertedCount > 0, nil
+}
+
+func (s *mongoStore) ReopenChat(ctx context.Context, chatID, reopenedBy string, at time.Time) (bool, error) {
+	filter := bson.M{"chatId": chatID, "status": "ended"}
+	update := bson.M{
+		"$set": bson.M{
+			"status":     "active",
+			"reopenedBy": reopenedBy,
+			"reopenedAt": at,
+		},
+		"$unset": bson.M{"closedAt": "", "closedBy": ""},
+	}
+	result, err := s.chats.UpdateOne(ctx, filter, update)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, errActiveChatExists
+	}
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+func (s *mongoStore) DeleteChats(ctx context.Context, chatIDs []string, status string) (int64, error) {
+	if len(chatIDs) == 0 {
+		return 0, nil
+	}
+	filter := bson.M{"chatId": bson.M{"$in": chatIDs}}
+	if status != "" {
+		filter["status"] = status
+	}
+	result, err := s.chats.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.archive.DeleteMany(ctx, bson.M{"chatId": bson.M{"$in": chatIDs}}); err != nil {
+		return result.DeletedCount, err
+	}
+	return result.DeletedCount, nil
+}
+
+// Archived messages after the marker come before the live ones
+func (s *mongoStore) MessagesSince(ctx context.Context, chatID, lastMessageID string, since time.Time, limit int) ([]ChatMessage, bool, error) {
+	archiveFilter := bson.M{"chatId": chatID, "timestamp": bson.M{"$gt": since}}
+	if lastMessageID != "" {
+		marker, err := s.findArchivedMessage(ctx, chatID, "msgId", lastMessageID)
+		switch {
+		case err == mongo.ErrNoDocuments:
+			archiveFilter = nil // The marker is live, or unknown
+		case err != nil:
+			return nil, false, err
+		default:
+			// Everything live is newer than an archived marker
+			archiveFilter = bson.M{"chatId": chatID, "index": bson.M{"$gt": marker.Index}}
+			lastMessageID, since = "", time.Time{}
+		}
+	}
+
+	// One extra tells whether more follow
+	var messages []ChatMessage
+	if archiveFilter != nil {
+		opts := options.Find().SetSort(bson.D{{Key: "index", Value: 1}}).SetLimit(int64(limit + 1))
+		cursor, err := s.archive.Find(ctx, archiveFilter, opts)
+		if err != nil {
+			return nil, false, err
+		}
+		var archived []ArchivedMessage
+		if err := cursor.All(ctx, &archived); err != nil {
+			return nil, false, err
+		}
+		for _, a := range archived {
+			messages = append(messages, a.ChatMessage)
+		}
+	}
+	if len(messages) <= limit {
+		live, err := s.liveMessagesSince(ctx, chatID, lastMessageID, since, limit+1-len(messages))
+		if err != nil {
+			return nil, false, err
+		}
+		messages = append(messages, live...)
+	}
+
+	if len(messages) > limit {
+		return messages[:limit], true, nil
+	}
+	return messages, false, nil
+}
+
+// The first limit messages of the live array after the marker
+func (s *mongoStore) liveMessagesSince(ctx context.Context, chatID, lastMessageID string, since time.Time, limit int) ([]ChatMessage, error) {
+	var newer interface{}
+	if lastMessageID != "" {
+		newer = bson.M{"$let": bson.M{
+			"vars": bson.M{"i": bson.M{"$indexOfArray": bson.A{"$messages.msgId", lastMessageID}}},
+			"in": bson.M{"$cond": bson.A{
+				bson.M{"$gte": bson.A{"$$i", 0}},
+				bson.M{"$slice": bson.A{"$messages", bson.M{"$add": bson.A{"$$i", 1}}, bson.M{"$size": "$messages"}}},
+				bson.A{},
+			}},
+		}}
+	} else {
+		newer = bson.M{"$filter": bson.M{
+			"input": "$messages",
+			"as":    "m",
+			"cond":  bson.M{"$gt": bson.A{"$$m.timestamp", since}},
+		}}
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"chatId": chatID}}},
+		{{Key: "$project", Value: bson.M{"messages": bson.M{"$ifNull": bson.A{"$messages", bson.A{}}}}}},
+		{{Key: "$project", Value: bson.M{"messages": bson.M{"$slice": bson.A{newer, limit}}}}},
+	}
+
+	cursor, err := s.chats.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var chat Chat
+	if !cursor.Next(ctx) {
+		if err := cursor.Err(); err != nil {
+			return nil, err
+		}
+		return nil, mongo.ErrNoDocuments
+	}
+	if err := cursor.Decode(&chat); err != nil {
+		return nil, err
+	}
+	return chat.Messages, nil
+}
+
+// Older deployments allowed a user several active chats, which keeps the
+// one-active-chat index from being built. Such chats are only logged unless
+// RESOLVE_DUPLICATE_ACTIVE_CHATS is on; then all but each user's most recently
+// active one are closed with a notice. Turn it off again once the index exists.
+var resolveDuplicateChats = getEnv("RESOLVE_DUPLICATE_ACTIVE_CHATS", "false") == "true"
+
+var errDuplicateActiveChats = errors.New("users have several active chats; set RESOLVE_DUPLICATE_ACTIVE_CHATS=true to close all but the newest")
+
+// A user's active chats, most recently active first
+type duplicateActiveChats struct {
+	UserEmail string   `bson:"_id"`
+	ChatIDs   []string `bson:"chatIds"`
+}
+
+// Log users with several active chats, or with resolveDuplicateChats close
+// all but their newest. Returns false when duplicates are left in place.
+func resolveDuplicateActiveChats(ctx context.Context, store ChatStore, duplicates []duplicateActiveChats) bool {
+	for _, dup := range duplicates {
+		if !resolveDuplicateChats {
+			slog.Warn("User has several active chats", "event", "startup", "userEmail", dup.UserEmail, "chatIds", dup.ChatIDs)
+			continue
+		}
+		for _, chatID := range dup.ChatIDs[1:] {
+			closeChatWithNotice(ctx, store, chatID, "This chat was closed because you have a newer active chat.", "startup")
+		}
+		slog.Warn("Closed duplicate active chats", "event", "startup", "userEmail", dup.UserEmail, "kept", dup.ChatIDs[0], "closed", dup.ChatIDs[1:])
+	}
+	return len(duplicates) == 0 || resolveDuplicateChats
+}
+
+// One active chat per user, see resolveDuplicateChats
+func (s *mongoStore) ensureActiveChatIndex(ctx context.Context) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"status": "active"}}},
+		{{Key: "$sort", Value: bson.D{{Key: "lastMessageTime", Value: -1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$userEmail", "chatIds": bson.M{"$push": "$chatId"}}}},
+		{{Key: "$match", Value: bson.M{"chatIds.1": bson.M{"$exists": true}}}},
+	}
+	cursor, err := s.chats.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	var duplicates []duplicateActiveChats
+	if err := cursor.All(ctx, &duplicates); err != nil {
+		return err
+	}
+	if !resolveDuplicateActiveChats(ctx, s, duplicates) {
+		return errDuplicateActiveChats
+	}
+
+	_, err = s.chats.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "userEmail", Value: 1}},
+		Options: options.Index().
+			SetName("userEmail_active_unique").
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"status": "active"}),
+	})
+	return err
+}
+
+// Create the indexes the queries rely on. CreateMany is a no-op for indexes
+// that already exist with the same definition, so this is safe on every start.
+func (s *mongoStore) ensureIndexes(ctx context.Context) error {
+	models := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "chatId", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "userEmail", Value: 1}, {Key: "status", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "lastMessageTime", Value: -1}}},
+		{Keys: bson.D{{Key: "tags", Value: 1}}},
+		{Keys: bson.D{{Key: "messages.message", Value: "text"}}},
+	}
+
+	if _, err := s.chats.Indexes().CreateMany(ctx, models); err != nil {
+		return err
+	}
+	if err := s.ensureActiveChatIndex(ctx); err != nil {
+		// Connects still check for an active chat first, only the race goes unguarded
+		slog.Error("Error creating the one-active-chat-per-user index", "event", "startup", "error", err)
+	}
+	if err := s.ensureArchiveIndexes(ctx); err != nil {
+		return err
+	}
+	return s.ensureScheduleIndexes(ctx)
+}
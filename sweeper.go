@@ -0,0 +1,21 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Call fn now and then every interval until ctx is cancelled. A slow run
+// delays the next one rather than overlapping it.
+func runSweeper(ctx context.Context, interval time.Duration, fn func(context.Context)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		fn(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
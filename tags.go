@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Tag limits
+const (
+	maxTagChars    = 32
+	maxTagsPerCall = 20
+)
+
+var errInvalidTag = errors.New("tags must be 1-32 characters")
+
+// Tags are compared case-insensitively, so they are stored lowercased
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" || utf8.RuneCountInString(tag) > maxTagChars {
+		return "", errInvalidTag
+	}
+	return tag, nil
+}
+
+// Add tags to a chat (admins only)
+func addChatTags(store ChatStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Tags []string `json:"tags"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || len(body.Tags) == 0 {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "tags is required")
+			return
+		}
+		if len(body.Tags) > maxTagsPerCall {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "too many tags")
+			return
+		}
+		tags := make([]string, len(body.Tags))
+		for i, tag := range body.Tags {
+			normalized, err := normalizeTag(tag)
+			if err != nil {
+				respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+				return
+			}
+			tags[i] = normalized
+		}
+
+		updateChatTags(c, store, tags, nil)
+	}
+}
+
+// Remove a tag from a chat (admins only)
+func removeChatTag(store ChatStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tag, err := normalizeTag(c.Param("tag"))
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+
+		updateChatTags(c, store, nil, []string{tag})
+	}
+}
+
+// Apply a tag update for an admin and respond with the chat's tags
+func updateChatTags(c *gin.Context, store ChatStore, add, remove []string) {
+	claims, err := authenticate(c.Request)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+		return
+	}
+	if !claims.IsAdmin() {
+		respondError(c, http.StatusForbidden, codeForbidden, "Admin role required")
+		return
+	}
+	chatID := c.Param("chatId")
+
+	ctx, cancel := dbContext(c.Request.Context())
+	defer cancel()
+
+	tags, err := store.UpdateTags(ctx, chatID, add, remove)
+	if err == mongo.ErrNoDocuments {
+		respondError(c, http.StatusNotFound, codeChatNotFound, "chat not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Error updating chat tags", "event", "chat_tags", "chatId", chatID, "error", err)
+		respondDBError(c, err, "Could not update tags")
+		return
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+
+	respond(c, http.StatusOK, gin.H{"chatId": chatID, "tags": tags})
+}
+
+func (s *mongoStore) UpdateTags(ctx context.Context, chatID string, add, remove []string) ([]string, error) {
+	update := bson.M{}
+	if len(add) > 0 {
+		update["$addToSet"] = bson.M{"tags": bson.M{"$each": add}}
+	}
+	if len(remove) > 0 {
+		update["$pull"] = bson.M{"tags": bson.M{"$in": remove}}
+	}
+
+	var chat Chat
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(bson.M{"tags": 1})
+	err := s.chats.FindOneAndUpdate(ctx, bson.M{"chatId": chatID}, update, opts).Decode(&chat)
+	return chat.Tags, err
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Attachment metadata stored on a message
+type Attachment struct {
+	URL         string `bson:"url" json:"url"`
+	FileName    string `bson:"fileName" json:"fileName"`
+	ContentType string `bson:"contentType" json:"contentType"`
+	Size        int64  `bson:"size" json:"size"`
+}
+
+// Upload settings. Files are stored under uploadDir/<chatId>/, served locally
+// at /uploads and linked through uploadBaseURL (which may point at a CDN in front of it).
+var (
+	uploadDir          = getEnv("UPLOAD_DIR", "uploads")
+	uploadBaseURL      = strings.TrimSuffix(getEnv("UPLOAD_BASE_URL", "/uploads"), "/")
+	maxUploadBytes     = int64(getEnvInt("MAX_UPLOAD_BYTES", 10<<20))
+	allowedUploadTypes = getEnvList("UPLOAD_CONTENT_TYPES")
+)
+
+// Content types accepted when UPLOAD_CONTENT_TYPES is not set
+var defaultUploadTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp", "application/pdf"}
+
+const maxAttachmentsPerMessage = 10
+
+var (
+	errInvalidAttachment  = errors.New("attachments must be uploaded to this chat first")
+	errTooManyAttachments = errors.New("too many attachments")
+)
+
+// Attachments may only point at files uploaded to the same chat
+func validateAttachments(chatID string, attachments []Attachment) error {
+	if len(attachments) > maxAttachmentsPerMessage {
+		return errTooManyAttachments
+	}
+	prefix := uploadBaseURL + "/" + chatID + "/"
+	for _, a := range attachments {
+		if !strings.HasPrefix(a.URL, prefix) || strings.Contains(a.URL[len(prefix):], "/") {
+			return errInvalidAttachment
+		}
+	}
+	return nil
+}
+
+// Append an attachment to an existing message, e.g. once an upload that a
+// placeholder message announced has finished. Only the sender may attach.
+func attachToMessage(ctx context.Context, store ChatStore, chatID, msgID, sender string, attachment Attachment) (ChatMessage, error) {
+	if err := validateAttachments(chatID, []Attachment{attachment}); err != nil {
+		return ChatMessage{}, err
+	}
+	msg, err := store.FindMessage(ctx, chatID, msgID)
+	if err != nil {
+		return msg, err
+	}
+	if msg.Deleted {
+		return msg, errMessageNotFound
+	}
+	if msg.Sender != sender {
+		return msg, errNotMessageOwner
+	}
+
+	added, err := store.AddAttachment(ctx, chatID, msgID, sender, attachment)
+	if err != nil {
+		return msg, err
+	}
+	if !added {
+		return msg, errTooManyAttachments
+	}
+
+	msg.Attachments = append(msg.Attachments, attachment)
+	return msg, nil
+}
+
+func (s *mongoStore) AddAttachment(ctx context.Context, chatID, msgID, sender string, attachment Attachment) (bool, error) {
+	// The cap is part of the filter so concurrent attaches can't exceed it
+	filter := bson.M{"chatId": chatID, "messages": bson.M{"$elemMatch": bson.M{
+		"msgId":  msgID,
+		"sender": sender,
+		"attachments." + strconv.Itoa(maxAttachmentsPerMessage-1): bson.M{"$exists": false},
+	}}}
+	update := bson.M{"$push": bson.M{"messages.$.attachments": attachment}}
+	result, err := s.chats.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+// Whether a sniffed content type may be uploaded
+func uploadTypeAllowed(contentType string) bool {
+	allowed := allowedUploadTypes
+	if len(allowed) == 0 {
+		allowed = defaultUploadTypes
+	}
+	for _, t := range allowed {
+		if t == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// chatId becomes a directory name under uploadDir
+func validUploadDirName(chatID string) bool {
+	return chatID != "" && chatID != "." && chatID != ".." && !strings.ContainsAny(chatID, `/\`)
+}
+
+// Delete the files uploaded to chats that were deleted. Failures are only
+// logged; a leftover directory costs disk space, not correctness.
+func removeChatUploads(chatIDs []string) {
+	for _, chatID := range chatIDs {
+		if !validUploadDirName(chatID) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(uploadDir, chatID)); err != nil {
+			slog.Error("Error removing chat uploads", "event", "upload_cleanup", "chatId", chatID, "error", err)
+		}
+	}
+}
+
+// Store a file for a chat and return its attachment metadata.
+// The client then sends the metadata along with its message.
+func uploadAttachment(store ChatStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := authenticate(c.Request)
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, codeUnauthorized, "Unauthorized")
+			return
+		}
+
+		chatID := c.Param("chatId")
+		if chatID == "" {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "chatId is required")
+			return
+		}
+		if !validUploadDirName(chatID) {
+			respondError(c, http.StatusBadRequest, codeInvalidChatID, "invalid chatId")
+			return
+		}
+
+		ctx, cancel := dbContext(c.Request.Context())
+		chat, err := store.GetChat(ctx, chatID)
+		cancel()
+		if err == mongo.ErrNoDocuments {
+			respondError(c, http.StatusNotFound, codeChatNotFound, "chat not found")
+			return
+		}
+		if err != nil {
+			slog.Error("Database error while fetching chat", "event", "upload", "chatId", chatID, "error", err)
+			respondDBError(c, err, "Database error")
+			return
+		}
+		// Only the chat's customer and admins may upload to it
+		if !claims.IsAdmin() && chat.UserEmail != claims.Email {
+			respondError(c, http.StatusForbidden, codeForbidden, errNotParticipant.Error())
+			return
+		}
+		if chat.Status == "ended" {
+			respondError(c, http.StatusConflict, codeChatClosed, "Chat is closed")
+			return
+		}
+
+		// Allow a little room for the multipart envelope around the file
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadBytes+1<<20)
+		fileHeader, err := c.FormFile("file")
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "file is required and must not exceed the upload limit")
+			return
+		}
+		if fileHeader.Size > maxUploadBytes {
+			respondError(c, http.StatusRequestEntityTooLarge, codeFileTooLarge, "file is too large")
+			return
+		}
+
+		file, err := fileHeader.Open()
+		if err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "Could not read file")
+			return
+		}
+		defer file.Close()
+
+		// Trust the file's content, not the type the client claims
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(file, head)
+		contentType := http.DetectContentType(head[:n])
+		if i := strings.Index(contentType, ";"); i >= 0 {
+			contentType = contentType[:i]
+		}
+		if !uploadTypeAllowed(contentType) {
+			respondError(c, http.StatusUnsupportedMediaType, codeUnsupportedFileType, "File type "+contentType+" is not allowed")
+			return
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "Could not read file")
+			return
+		}
+
+		ext := filepath.Ext(fileHeader.Filename)
+		if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+			ext = exts[0]
+		}
+		name := uuid.New().String() + ext
+
+		dir := filepath.Join(uploadDir, chatID)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			slog.Error("Error creating upload directory", "event", "upload", "chatId", chatID, "error", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Could not store file")
+			return
+		}
+		out, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			slog.Error("Error creating upload file", "event", "upload", "chatId", chatID, "error", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Could not store file")
+			return
+		}
+		size, err := io.Copy(out, file)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			slog.Error("Error writing upload file", "event", "upload", "chatId", chatID, "error", err)
+			respondError(c, http.StatusInternalServerError, codeInternal, "Could not store file")
+			return
+		}
+
+		respond(c, http.StatusCreated, Attachment{
+			URL:         uploadBaseURL + "/" + chatID + "/" + name,
+			FileName:    filepath.Base(fileHeader.Filename),
+			ContentType: contentType,
+			Size:        size,
+		})
+	}
+}
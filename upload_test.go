@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// POST a PNG to the chat's upload endpoint as the claims' user
+func postUpload(t *testing.T, store ChatStore, chatID string, claims Claims) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "screenshot.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"))
+	form.Close()
+
+	router := gin.New()
+	router.POST("/chat/:chatId/upload", uploadAttachment(store))
+	req := httptest.NewRequest(http.MethodPost, "/chat/"+chatID+"/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+testToken(t, claims))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestUploadAttachmentParticipants(t *testing.T) {
+	tests := []struct {
+		name       string
+		claims     Claims
+		wantStatus int
+	}{
+		{"chat owner", Claims{Email: "user@example.com"}, http.StatusCreated},
+		{"admin", Claims{Email: "agent@example.com", Role: roleAdmin}, http.StatusCreated},
+		{"another customer", Claims{Email: "other@example.com"}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(dir string) { uploadDir = dir }(uploadDir)
+			uploadDir = t.TempDir()
+			store := newFakeStore()
+			store.addChat(Chat{ChatID: "c1", UserEmail: "user@example.com"})
+
+			w := postUpload(t, store, "c1", tt.claims)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			files, _ := os.ReadDir(filepath.Join(uploadDir, "c1"))
+			if stored := len(files) > 0; stored != (tt.wantStatus == http.StatusCreated) {
+				t.Errorf("stored %d files for status %d", len(files), w.Code)
+			}
+		})
+	}
+}
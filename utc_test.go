@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run the test with the server's local zone away from UTC
+func useLocalZone(t *testing.T) {
+	t.Helper()
+	saved := time.Local
+	time.Local = time.FixedZone("UTC+5", 5*60*60)
+	t.Cleanup(func() { time.Local = saved })
+}
+
+func TestTimestampsAreUTC(t *testing.T) {
+	useLocalZone(t)
+	store := newFakeStore()
+
+	// The connection creates the chat
+	ws := dialChat(t, startWS(t, store), Claims{Email: "user@example.com"}, map[string]string{"chatId": testChatID})
+	init := readFrame(t, ws, "init")
+	ws.WriteJSON(map[string]string{"type": "message", "message": "hello", "clientMsgId": "c-1"})
+	ack := readFrame(t, ws, "ack")
+	for name, value := range map[string]interface{}{"init serverTime": init["serverTime"], "ack timestamp": ack["timestamp"]} {
+		if s, _ := value.(string); !strings.HasSuffix(s, "Z") {
+			t.Errorf("%s = %v, want a UTC timestamp", name, value)
+		}
+	}
+
+	token := testToken(t, Claims{Email: "user@example.com"})
+	w := serve(http.MethodPost, "/chat/:chatId/message", "/chat/"+testChatID+"/message", strings.NewReader(`{"message":"over http"}`), token, postMessage(store))
+	var posted ChatMessage
+	if apiErr := decodeEnvelope(t, w, &posted); apiErr != nil {
+		t.Fatalf("posting: %+v", apiErr)
+	}
+	if posted.Timestamp.Location() != time.UTC {
+		t.Errorf("posted timestamp %v is not UTC", posted.Timestamp)
+	}
+
+	chat, _ := store.chat(testChatID)
+	for _, msg := range chat.Messages {
+		if msg.Timestamp.Location() != time.UTC {
+			t.Errorf("stored %q at %v, want UTC", msg.Message, msg.Timestamp)
+		}
+	}
+	if chat.CreatedAt.IsZero() || chat.CreatedAt.Location() != time.UTC {
+		t.Errorf("createdAt %v is not UTC", chat.CreatedAt)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Build information, set at build time:
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// When unset, commit and buildTime fall back to the VCS stamp Go embeds in the binary.
+var (
+	version   = "dev"
+	commit    = ""
+	buildTime = ""
+)
+
+// BuildInfo identifies the running build
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"buildTime"`
+	GoVersion string `json:"goVersion"`
+}
+
+var currentBuild = readBuildInfo()
+
+func readBuildInfo() BuildInfo {
+	build := BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && build.Commit == "":
+				build.Commit = setting.Value
+			case setting.Key == "vcs.time" && build.BuildTime == "":
+				build.BuildTime = setting.Value
+			}
+		}
+	}
+	if build.Commit == "" {
+		build.Commit = "unknown"
+	}
+	if build.BuildTime == "" {
+		build.BuildTime = "unknown"
+	}
+	return build
+}
+
+// Report which build is running
+func getVersion(c *gin.Context) {
+	respond(c, http.StatusOK, currentBuild)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Every stored message is POSTed to WEBHOOK_URL when it is set. With
+// WEBHOOK_SECRET the body is signed in the X-Webhook-Signature header as
+// "sha256=" + hex HMAC-SHA256, so the receiver can verify it came from us.
+var (
+	webhookURL       = getEnv("WEBHOOK_URL", "")
+	webhookSecret    = getEnv("WEBHOOK_SECRET", "")
+	webhookTimeout   = getEnvDuration("WEBHOOK_TIMEOUT", 5*time.Second)
+	webhookRetries   = getEnvInt("WEBHOOK_RETRIES", 3)
+	webhookQueueSize = getEnvInt("WEBHOOK_QUEUE_SIZE", 1000)
+)
+
+// WebhookPayload is the JSON body sent for each message
+type WebhookPayload struct {
+	ChatID     string    `json:"chatId"`
+	MsgID      string    `json:"msgId"`
+	Message    string    `json:"message"`
+	Sender     string    `json:"sender"`
+	SenderRole string    `json:"senderRole"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// Messages waiting for delivery
+var webhookQueue = make(chan WebhookPayload, max(webhookQueueSize, 1))
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// Queue a message for the webhook without blocking the caller. When the
+// receiver falls too far behind the message is skipped, never the chat.
+func forwardToWebhook(chatID string, msg ChatMessage) {
+	if webhookURL == "" {
+		return
+	}
+	payload := WebhookPayload{
+		ChatID:     chatID,
+		MsgID:      msg.MsgID,
+		Message:    msg.Message,
+		Sender:     msg.Sender,
+		SenderRole: msg.SenderRole,
+		Timestamp:  msg.Timestamp,
+	}
+	select {
+	case webhookQueue <- payload:
+	default:
+		slog.Warn("Webhook queue full, skipping message", "event", "webhook", "chatId", chatID, "msgId", msg.MsgID)
+		webhookFailures.Inc()
+	}
+}
+
+// Deliver queued messages in order until ctx is cancelled
+func runWebhook(ctx context.Context) {
+	if webhookURL == "" {
+		slog.Info("Message webhook disabled", "event", "webhook")
+		return
+	}
+	slog.Info("Message webhook enabled", "event", "webhook", "retries", webhookRetries, "signed", webhookSecret != "")
+
+	for {
+		select {
+		case payload := <-webhookQueue:
+			deliverWebhook(ctx, payload)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// POST a payload, retrying with exponential backoff
+func deliverWebhook(ctx context.Context, payload WebhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("Error encoding webhook payload", "event", "webhook", "chatId", payload.ChatID, "error", err)
+		return
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err = postWebhook(ctx, body)
+		if err == nil {
+			return
+		}
+		if attempt >= webhookRetries {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return
+		}
+	}
+	slog.Error("Webhook delivery failed", "event", "webhook", "chatId", payload.ChatID, "msgId", payload.MsgID, "attempts", webhookRetries+1, "error", err)
+	webhookFailures.Inc()
+}
+
+func postWebhook(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if webhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(webhookSecret))
+		mac.Write(body)
+		req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Send webhook payloads to a fresh queue for the test
+func useWebhookQueue(t *testing.T) chan WebhookPayload {
+	t.Helper()
+	url, queue := webhookURL, webhookQueue
+	t.Cleanup(func() { webhookURL, webhookQueue = url, queue })
+	webhookURL = "http://webhook.example.com"
+	webhookQueue = make(chan WebhookPayload, 10)
+	return webhookQueue
+}
+
+func TestCloseChatForwardsStoredNotice(t *testing.T) {
+	useTestRegistry(t)
+	queue := useWebhookQueue(t)
+	store := newFakeStore()
+	store.addChat(testChat("c1", 1, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)))
+	admin := testToken(t, Claims{Email: "agent@example.com", Role: roleAdmin})
+
+	for i := 0; i < 2; i++ { // The second close finds the chat ended
+		w := serve(http.MethodPost, "/closeChat/:chatId", "/closeChat/c1", nil, admin, closeChat(store))
+		if w.Code != http.StatusOK {
+			t.Fatalf("close %d: status = %d, want 200: %s", i, w.Code, w.Body)
+		}
+	}
+
+	chat, _ := store.chat("c1")
+	if len(chat.Messages) != 2 || chat.Messages[1].SenderRole != roleSystem {
+		t.Fatalf("stored %+v, want the close notice after the message", chat.Messages)
+	}
+	notice := chat.Messages[1]
+	select {
+	case payload := <-queue:
+		if payload.MsgID == "" || payload.MsgID != notice.MsgID || payload.Message != notice.Message {
+			t.Errorf("webhook payload = %+v, want the stored notice %+v", payload, notice)
+		}
+	default:
+		t.Fatal("the close notice was not forwarded")
+	}
+	if len(queue) != 0 {
+		t.Errorf("%d more payloads queued, want only the notice", len(queue))
+	}
+}
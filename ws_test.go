@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A well-formed chat ID for WebSocket tests
+const testChatID = "3f2b8c1e-6a0d-4e5f-9b7a-2c4d6e8f0a1b"
+
+// Serve the WebSocket endpoint on a test server backed by the fake store.
+// Cleanup waits for the handlers, which outlive the hijacked connections.
+func startWS(t *testing.T, store *fakeStore) string {
+	t.Helper()
+	var handlers sync.WaitGroup
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		handleConnections(w, r, store, store)
+	}))
+	t.Cleanup(func() {
+		server.Close()
+		handlers.Wait()
+	})
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// Connect as the claims' user and send the init frame
+func dialChat(t *testing.T, url string, claims Claims, init interface{}) *websocket.Conn {
+	t.Helper()
+	header := http.Header{"Authorization": {"Bearer " + testToken(t, claims)}}
+	ws, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	if err := ws.WriteJSON(init); err != nil {
+		t.Fatalf("writing init: %v", err)
+	}
+	return ws
+}
+
+// Read frames until one of the given type arrives; fails on close or timeout
+func readFrame(t *testing.T, ws *websocket.Conn, frameType string) map[string]interface{} {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %q frame: %v", frameType, err)
+		}
+		var frame map[string]interface{}
+		if err := json.Unmarshal(data, &frame); err != nil {
+			t.Fatalf("decoding frame %s: %v", data, err)
+		}
+		if frame["type"] == frameType {
+			return frame
+		}
+	}
+}
+
+// Read frames until the server closes the connection and return its close code
+func readCloseCode(t *testing.T, ws *websocket.Conn) int {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := ws.ReadMessage()
+		if closeErr, ok := err.(*websocket.CloseError); ok {
+			return closeErr.Code
+		}
+		if err != nil {
+			t.Fatalf("waiting for close: %v", err)
+		}
+	}
+}
+
+func TestConnectParticipants(t *testing.T) {
+	tests := []struct {
+		name      string
+		claims    Claims
+		wantClose int // 0 when the connection is accepted
+	}{
+		{"chat owner", Claims{Email: "user@example.com"}, 0},
+		{"admin", Claims{Email: "agent@example.com", Role: roleAdmin}, 0},
+		{"another customer", Claims{Email: "other@example.com"}, closeForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			store.addChat(Chat{ChatID: testChatID, UserEmail: "user@example.com"})
+			url := startWS(t, store)
+
+			ws := dialChat(t, url, tt.claims, map[string]string{"chatId": testChatID})
+			if tt.wantClose == 0 {
+				if init := readFrame(t, ws, "init"); init["chatId"] != testChatID {
+					t.Errorf("init chatId = %v, want %s", init["chatId"], testChatID)
+				}
+				return
+			}
+			if code := readCloseCode(t, ws); code != tt.wantClose {
+				t.Errorf("close code = %d, want %d", code, tt.wantClose)
+			}
+		})
+	}
+}
+
+func TestReconnectReplaysOldestMissed(t *testing.T) {
+	store := newFakeStore()
+	chat := testChat(testChatID, maxReplayMessages+20, time.Now().Add(-time.Hour))
+	store.addChat(chat)
+	url := startWS(t, store)
+
+	ws := dialChat(t, url, Claims{Email: "user@example.com"}, map[string]interface{}{"chatId": testChatID, "lastMessageId": "m9", "batch": true})
+	batch := readFrame(t, ws, "batch")
+	messages := batch["messages"].([]interface{})
+	if len(messages) != maxReplayMessages {
+		t.Fatalf("replayed %d messages, want %d", len(messages), maxReplayMessages)
+	}
+	if first := messages[0].(map[string]interface{})["msgId"]; first != "m10" {
+		t.Errorf("first replayed message = %v, want m10", first)
+	}
+	more := readFrame(t, ws, "replayMore")
+	if want := fmt.Sprintf("m%d", 9+maxReplayMessages); more["lastMessageId"] != want {
+		t.Errorf("replayMore lastMessageId = %v, want %s", more["lastMessageId"], want)
+	}
+}
+
+func TestConcurrentConnectsCreateOneChat(t *testing.T) {
+	const connects = 8
+	store := newFakeStore()
+	url := startWS(t, store)
+
+	codes := make(chan int, connects)
+	var wg sync.WaitGroup
+	for i := 0; i < connects; i++ {
+		wg.Add(1)
+		go func(chatID string) {
+			defer wg.Done()
+			header := http.Header{"Authorization": {"Bearer " + testToken(t, Claims{Email: "user@example.com"})}}
+			ws, _, err := websocket.DefaultDialer.Dial(url, header)
+			if err != nil {
+				t.Errorf("dial: %v", err)
+				return
+			}
+			defer ws.Close()
+			ws.WriteJSON(map[string]string{"chatId": chatID})
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for {
+				_, data, err := ws.ReadMessage()
+				if closeErr, ok := err.(*websocket.CloseError); ok {
+					codes <- closeErr.Code
+					return
+				}
+				if err != nil {
+					t.Errorf("reading: %v", err)
+					return
+				}
+				var frame struct{ Type string }
+				if json.Unmarshal(data, &frame) == nil && frame.Type == "init" {
+					codes <- 0
+					return
+				}
+			}
+		}(fmt.Sprintf("3f2b8c1e-6a0d-4e5f-9b7a-2c4d6e8f0a%02d", i))
+	}
+	wg.Wait()
+	close(codes)
+
+	var accepted, rejected int
+	for code := range codes {
+		switch code {
+		case 0:
+			accepted++
+		case closeActiveChatExists:
+			rejected++
+		default:
+			t.Errorf("unexpected close code %d", code)
+		}
+	}
+	if accepted != 1 || rejected != connects-1 {
+		t.Errorf("%d accepted and %d rejected, want 1 and %d", accepted, rejected, connects-1)
+	}
+	if chatID, _ := store.ActiveChatID(context.Background(), "user@example.com"); chatID == "" {
+		t.Error("no active chat was created")
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	active := 0
+	for _, chat := range store.chats {
+		if chat.UserEmail == "user@example.com" && chat.Status == "active" {
+			active++
+		}
+	}
+	if active != 1 {
+		t.Errorf("%d active chats, want 1", active)
+	}
+}
+
+func TestGarbageFrameKeepsConnection(t *testing.T) {
+	store := newFakeStore()
+	store.addChat(Chat{ChatID: testChatID, UserEmail: "user@example.com"})
+	ws := dialChat(t, startWS(t, store), Claims{Email: "user@example.com"}, map[string]string{"chatId": testChatID})
+	readFrame(t, ws, "init")
+
+	for _, garbage := range []string{"{not json", `{"type": 42}`, ""} {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(garbage)); err != nil {
+			t.Fatal(err)
+		}
+		if frame := readFrame(t, ws, "error"); !strings.HasPrefix(frame["error"].(string), "Invalid frame") {
+			t.Errorf("error for %q = %v", garbage, frame["error"])
+		}
+	}
+
+	ws.WriteJSON(map[string]string{"type": "message", "message": "still here", "clientMsgId": "c-1"})
+	if ack := readFrame(t, ws, "ack"); ack["clientMsgId"] != "c-1" {
+		t.Errorf("ack = %v", ack)
+	}
+	if chat, _ := store.chat(testChatID); len(chat.Messages) != 1 || chat.Messages[0].Message != "still here" {
+		t.Errorf("stored %v, want the valid message", chat.Messages)
+	}
+}